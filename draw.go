@@ -5,6 +5,9 @@ package main
 
 import (
     "fmt"
+    "os"
+    "io/ioutil"
+    "strings"
     "exp/draw/x11"
     "exp/draw"
     "image"
@@ -13,11 +16,17 @@ import (
 )
 
 const (
-    HMAX = 600
-    WMAX = 800
     SEARCH_RADIUS = 10
     SIDE_RATIO = 0.4 // Ratio for circle sides per radius
     BUF_SIZE = 100
+    SNAP_RADIUS = 8
+    SNAP_MARK = 4 // Half size of the snap indicator
+)
+
+const (
+    KEY_BACKSPACE = 0xff08
+    KEY_RETURN = 0xff0d
+    KEY_ESCAPE = 0xff1b
 )
 
 const (
@@ -28,120 +37,2695 @@ const (
 
 /* Global Variables */
 
-var counter_id = 0
-var matrix =  new([WMAX][HMAX]list.List)
-var currentCounter = 0
-var currentColor     = image.RGBAColor{255, 255, 255, 255}
-var currentDashStyle = 0
-var currentThick     = false
+var screenRect = image.Rect(0, 0, 800, 600)
+
+/* Document */
+
+// A drawing: its objects, windows and the state of the tools
+type Document struct {
+    layers *list.List // Of *Layer, the top last
+    active *Layer // Where new objects go
+    index *QuadTree
+    counter_id int
+    windows *list.List
+    counter int
+    style FigProps
+    snap bool
+    grid Grid
+    angleConstraint bool
+    angleStep int // Degrees
+    lastPoint image.Point // Reference for relative coordinates
+    lastHitPoint image.Point
+    lastHitIndex int
+    undo *list.List // Of Operation, the last done at the back
+    redo *list.List
+    historyLimit int // Operations kept for undo, 0 for no limit
+    transaction *list.List // Operations of the command being done
+    selection *list.List
+    motion chan MouseEvent // Drags and moves of the mouse, for previews
+    preview func(image.Point) Drawable // Shape following the mouse
+    previewOut chan chan ColorPoint
+    previewShown image.Rectangle
+    cursor image.Point // Last position of the mouse seen by Click or Motion
+    indicators chan chan ColorPoint // Where the snap marker is drawn, nil for none
+    snapMarker *SnapTarget // Shown on the screen
+    sketch *list.List // Points of the shape being drawn, to snap to
+}
+
+func NewDocument() *Document {
+    doc := new(Document)
+    doc.layers = new(list.List)
+    doc.active = NewLayer("Camada 1")
+    doc.layers.PushBack(doc.active)
+    doc.index = NewQuadTree()
+    doc.windows = new(list.List)
+    doc.style = FigProps{image.RGBAColor{255, 255, 255, 255}, SOLID, false}
+    doc.snap = true
+    doc.grid = Grid{image.Point{0, 0}, 20, false, false}
+    doc.angleStep = 15
+    doc.ResetHitCycle()
+    doc.undo = new(list.List)
+    doc.redo = new(list.List)
+    doc.selection = new(list.List)
+    doc.motion = make(chan MouseEvent, BUF_SIZE)
+    return doc
+}
+
+func (doc *Document) NewId() int {
+    doc.counter_id++
+    return doc.counter_id
+}
+
+/* End document */
+
+/* History */
+
+// A change to the document that can be undone and done again
+type Operation interface {
+    Undo(doc *Document, out chan chan ColorPoint)
+    Redo(doc *Document, out chan chan ColorPoint)
+}
+
+// Saves op for undo. Inside a transaction it is kept to be saved with
+// the others of the same command
+func (doc *Document) Record(op Operation) {
+    doc.ResetHitCycle()
+    if doc.transaction != nil {
+        doc.transaction.PushBack(op)
+        return
+    }
+    doc.undo.PushBack(op)
+    doc.redo.Init()
+    doc.TrimHistory()
+}
+
+// Forgets the oldest operations past historyLimit
+func (doc *Document) TrimHistory() {
+    for doc.historyLimit > 0 && doc.undo.Len() > doc.historyLimit {
+        doc.undo.Remove(doc.undo.Front())
+    }
+}
+
+// Sets how many operations can be undone, 0 for no limit
+func HistoryLimitHandler(doc *Document, clickchan <-chan image.Point, kbchan chan int) {
+    fmt.Println("Limite do historico (0 sem limite):", doc.historyLimit)
+    value, ok := doc.NextNumber(clickchan, kbchan)
+    if !ok { return }
+    if value < 0 {
+        fmt.Println("Limite invalido:", value)
+        return
+    }
+    doc.historyLimit = int(value)
+    doc.TrimHistory()
+    fmt.Println("Limite do historico:", doc.historyLimit)
+}
+
+// Starts a command made of several operations, undone in one step
+func (doc *Document) Begin() {
+    doc.transaction = new(list.List)
+}
+
+func (doc *Document) Commit() {
+    ops := doc.transaction
+    doc.transaction = nil
+    if ops != nil && ops.Len() > 0 {
+        doc.Record(&CompositeOp{ops})
+    }
+}
+
+func (doc *Document) Undo(out chan chan ColorPoint) {
+    if doc.undo.Len() == 0 {
+        fmt.Println("Nada para desfazer")
+        return
+    }
+    elem := doc.undo.Back()
+    op := elem.Value.(Operation)
+    doc.undo.Remove(elem)
+    op.Undo(doc, out)
+    doc.redo.PushBack(op)
+    fmt.Println("Desfeito")
+}
+
+func (doc *Document) Redo(out chan chan ColorPoint) {
+    if doc.redo.Len() == 0 {
+        fmt.Println("Nada para refazer")
+        return
+    }
+    elem := doc.redo.Back()
+    op := elem.Value.(Operation)
+    doc.redo.Remove(elem)
+    op.Redo(doc, out)
+    doc.undo.PushBack(op)
+    fmt.Println("Refeito")
+}
+
+type CreateOp struct {
+    drawable Drawable
+    layer *Layer
+}
+
+func (op *CreateOp) Undo(doc *Document, out chan chan ColorPoint) {
+    doc.Unregister(op.drawable)
+    doc.Refresh(Damage(op.drawable), out)
+}
+
+func (op *CreateOp) Redo(doc *Document, out chan chan ColorPoint) {
+    doc.Restore(op.drawable, op.layer, -1, out)
+}
+
+type DeleteOp struct {
+    drawable Drawable
+    layer *Layer
+    pos int // In the layer, from the bottom
+}
+
+func (op *DeleteOp) Undo(doc *Document, out chan chan ColorPoint) {
+    doc.Restore(op.drawable, op.layer, op.pos, out)
+}
+
+func (op *DeleteOp) Redo(doc *Document, out chan chan ColorPoint) {
+    doc.Unregister(op.drawable)
+    doc.Refresh(Damage(op.drawable), out)
+}
+
+type MoveOp struct {
+    drawable Drawable
+    delta image.Point
+}
+
+func (op *MoveOp) Undo(doc *Document, out chan chan ColorPoint) {
+    old := op.drawable.Bounds()
+    op.drawable.Move(image.Point{-op.delta.X, -op.delta.Y})
+    doc.Update(op.drawable, old, out)
+}
+
+func (op *MoveOp) Redo(doc *Document, out chan chan ColorPoint) {
+    old := op.drawable.Bounds()
+    op.drawable.Move(op.delta)
+    doc.Update(op.drawable, old, out)
+}
+
+// Changes that don't map back exactly on integer points, as rotations,
+// keep the object as it was before
+type ReplaceOp struct {
+    before Drawable
+    after Drawable
+}
+
+func (op *ReplaceOp) Undo(doc *Document, out chan chan ColorPoint) {
+    doc.Swap(op.after, op.before, out)
+}
+
+func (op *ReplaceOp) Redo(doc *Document, out chan chan ColorPoint) {
+    doc.Swap(op.before, op.after, out)
+}
+
+type StyleOp struct {
+    before FigProps
+    after FigProps
+}
+
+func (op *StyleOp) Undo(doc *Document, out chan chan ColorPoint) {
+    doc.style = op.before
+}
+
+func (op *StyleOp) Redo(doc *Document, out chan chan ColorPoint) {
+    doc.style = op.after
+}
+
+// Adds, removes or changes the window at pos. A nil window is no window
+type WindowOp struct {
+    pos int
+    before *Window
+    after *Window
+}
+
+func (op *WindowOp) Undo(doc *Document, out chan chan ColorPoint) {
+    doc.PutWindow(op.pos, op.after, op.before, out)
+}
+
+func (op *WindowOp) Redo(doc *Document, out chan chan ColorPoint) {
+    doc.PutWindow(op.pos, op.before, op.after, out)
+}
+
+type LayerOp struct {
+    drawable Drawable
+    from *Layer
+    pos int // In from, from the bottom
+    to *Layer
+}
+
+func (op *LayerOp) Undo(doc *Document, out chan chan ColorPoint) {
+    doc.Unregister(op.drawable)
+    doc.Restore(op.drawable, op.from, op.pos, out)
+}
+
+func (op *LayerOp) Redo(doc *Document, out chan chan ColorPoint) {
+    doc.Unregister(op.drawable)
+    doc.Restore(op.drawable, op.to, -1, out)
+}
+
+type ZOrderOp struct {
+    drawable Drawable
+    layer *Layer
+    before int
+    after int
+}
+
+func (op *ZOrderOp) Undo(doc *Document, out chan chan ColorPoint) {
+    doc.Unregister(op.drawable)
+    doc.Restore(op.drawable, op.layer, op.before, out)
+}
+
+func (op *ZOrderOp) Redo(doc *Document, out chan chan ColorPoint) {
+    doc.Unregister(op.drawable)
+    doc.Restore(op.drawable, op.layer, op.after, out)
+}
+
+type CompositeOp struct {
+    ops *list.List
+}
+
+func (op *CompositeOp) Undo(doc *Document, out chan chan ColorPoint) {
+    for elem := op.ops.Back(); elem != nil; elem = elem.Prev() {
+        elem.Value.(Operation).Undo(doc, out)
+    }
+}
+
+func (op *CompositeOp) Redo(doc *Document, out chan chan ColorPoint) {
+    for elem := op.ops.Front(); elem != nil; elem = elem.Next() {
+        elem.Value.(Operation).Redo(doc, out)
+    }
+}
+
+/* End history */
+
+/* Selection */
+
+const SELECTION_MARGIN = 3
+
+var selectionColor = image.RGBAColor{255, 0, 255, 255}
+
+// What must be repainted when drawable changes, with its selection mark
+func Damage(drawable Drawable) image.Rectangle {
+    return RectExpand(drawable.Bounds(), SELECTION_MARGIN + 1)
+}
+
+// Dotted box around the bounds of a selected object
+func SelectionBox(drawable Drawable) *list.List {
+    r := RectExpand(drawable.Bounds(), SELECTION_MARGIN)
+    props := FigProps{selectionColor, DOTTED, false}
+    a := r.Min
+    b := image.Point{r.Max.X - 1, r.Min.Y}
+    c := image.Point{r.Max.X - 1, r.Max.Y - 1}
+    d := image.Point{r.Min.X, r.Max.Y - 1}
+    lines := new(list.List)
+    lines.PushBack(&Line{a, b, props, Id{0}})
+    lines.PushBack(&Line{b, c, props, Id{0}})
+    lines.PushBack(&Line{c, d, props, Id{0}})
+    lines.PushBack(&Line{d, a, props, Id{0}})
+    return lines
+}
+
+func (doc *Document) IsSelected(drawable Drawable) bool {
+    return ListContains(doc.selection, drawable)
+}
+
+func (doc *Document) Select(drawable Drawable, out chan chan ColorPoint) {
+    if doc.IsSelected(drawable) { return }
+    doc.selection.PushBack(drawable)
+    doc.Refresh(Damage(drawable), out)
+}
+
+func (doc *Document) Deselect(drawable Drawable, out chan chan ColorPoint) {
+    for elem := doc.selection.Front(); elem != nil; elem = elem.Next() {
+        if elem.Value.(Drawable) == drawable {
+            doc.selection.Remove(elem)
+            doc.Refresh(Damage(drawable), out)
+            return
+        }
+    }
+}
+
+func (doc *Document) ClearSelection(out chan chan ColorPoint) {
+    old := doc.Selected()
+    doc.selection.Init()
+    for elem := old.Front(); elem != nil; elem = elem.Next() {
+        doc.Refresh(Damage(elem.Value.(Drawable)), out)
+    }
+    windows := doc.SelectedWindows()
+    for elem := windows.Front(); elem != nil; elem = elem.Next() {
+        doc.SelectWindow(elem.Value.(int), false, out)
+    }
+}
+
+// The selected objects still in a visible layer, from the bottom up.
+// Objects deleted or hidden since they were selected leave the selection
+func (doc *Document) Selected() *list.List {
+    doc.selection = doc.ZOrdered(doc.selection)
+    sorted := new(list.List)
+    sorted.PushBackList(doc.selection)
+    return sorted
+}
+
+// The selected objects that are not in a locked layer
+func (doc *Document) SelectedEditables() *list.List {
+    draws := new(list.List)
+    selected := doc.Selected()
+    for elem := selected.Front(); elem != nil; elem = elem.Next() {
+        if doc.Editable(elem.Value.(Drawable)) {
+            draws.PushBack(elem.Value)
+        }
+    }
+    return draws
+}
+
+// All objects in visible layers
+func (doc *Document) All() *list.List {
+    all := new(list.List)
+    for l := doc.layers.Front(); l != nil; l = l.Next() {
+        all.PushBackList(l.Value.(*Layer).drawables)
+    }
+    return doc.ZOrdered(all)
+}
+
+// Changes the style of the selected objects
+func (doc *Document) RestyleSelection(change func(*FigProps), out chan chan ColorPoint) {
+    draws := doc.SelectedEditables()
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        restyled := drawable.Clone()
+        restyled.SetId(drawable.GetId())
+        restyled.Restyle(change)
+        doc.Replace(drawable, restyled, out)
+    }
+}
+
+/* End selection */
+
+/* Vertex editing */
+
+const HANDLE_SIZE = 3
+
+var handleColor = image.RGBAColor{255, 0, 255, 255}
+var activeHandleColor = image.RGBAColor{255, 255, 0, 255}
+
+// Points that reshape drawable when dragged: the vertices of lines and
+// poligons, the radius of circles, the ends of arcs and the start of
+// regular poligons
+func Handles(drawable Drawable) *list.List {
+    handles := new(list.List)
+    switch d := drawable.(type) {
+    case *Line:
+        handles.PushBack(d.start)
+        handles.PushBack(d.end)
+    case *Poligon:
+        handles.PushBackList(d.points)
+    case *RegularPoligon:
+        handles.PushBack(d.start)
+    case *Circle:
+        handles.PushBack(d.start)
+    case *CircleArc:
+        handles.PushBack(d.start)
+        handles.PushBack(RotatePoint(d.start, d.center, d.angle))
+    }
+    return handles
+}
+
+func SetHandle(drawable Drawable, i int, p image.Point) {
+    switch d := drawable.(type) {
+    case *Line:
+        if i == 0 {
+            d.start = p
+        } else {
+            d.end = p
+        }
+    case *Poligon:
+        elem := d.points.Front()
+        for ; i > 0 && elem != nil; i-- {
+            elem = elem.Next()
+        }
+        if elem != nil {
+            elem.Value = p
+        }
+    case *RegularPoligon:
+        d.start = p
+    case *Circle:
+        d.start = p
+    case *CircleArc:
+        if i == 0 {
+            // Keeps the sweep
+            d.start = p
+        } else {
+            sweep := math.Fmod(Theta(p.Sub(d.center)) - Theta(d.start.Sub(d.center)), 2*math.Pi)
+            if sweep <= 0 { sweep += 2*math.Pi }
+            d.angle = sweep
+        }
+    }
+}
+
+// Index of the handle within SEARCH_RADIUS of p, or -1
+func NearestHandle(handles *list.List, p image.Point) int {
+    best := -1
+    best_dist := float64(SEARCH_RADIUS)
+    i := 0
+    for elem := handles.Front(); elem != nil; elem = elem.Next() {
+        dist := PointsDistance(p, elem.Value.(image.Point))
+        if dist <= best_dist {
+            best = i
+            best_dist = dist
+        }
+        i++
+    }
+    return best
+}
+
+// Adds p as a vertex of the poligon on its edge closest to p
+func InsertVertex(drawable Drawable, p image.Point) bool {
+    poligon, ok := drawable.(*Poligon)
+    if !ok || poligon.points.Len() < 2 {
+        return false
+    }
+    var best *list.Element
+    best_dist := 0.0
+    before := poligon.points.Back().Value.(image.Point)
+    for elem := poligon.points.Front(); elem != nil; elem = elem.Next() {
+        after := elem.Value.(image.Point)
+        dist := Segment{before, after}.DistanceTo(p)
+        if best == nil || dist < best_dist {
+            best = elem
+            best_dist = dist
+        }
+        before = after
+    }
+    if best == poligon.points.Front() {
+        // The closing edge
+        poligon.points.PushBack(p)
+    } else {
+        poligon.points.InsertBefore(p, best)
+    }
+    return true
+}
+
+func DeleteVertex(drawable Drawable, i int) bool {
+    poligon, ok := drawable.(*Poligon)
+    if !ok || poligon.points.Len() <= 2 {
+        return false
+    }
+    elem := poligon.points.Front()
+    for ; i > 0 && elem != nil; i-- {
+        elem = elem.Next()
+    }
+    if elem == nil {
+        return false
+    }
+    poligon.points.Remove(elem)
+    return true
+}
+
+func HandleMarker(p image.Point, color image.RGBAColor) Drawable {
+    square := new(list.List)
+    square.PushBack(p.Add(image.Point{-HANDLE_SIZE, -HANDLE_SIZE}))
+    square.PushBack(p.Add(image.Point{HANDLE_SIZE, -HANDLE_SIZE}))
+    square.PushBack(p.Add(image.Point{HANDLE_SIZE, HANDLE_SIZE}))
+    square.PushBack(p.Add(image.Point{-HANDLE_SIZE, HANDLE_SIZE}))
+    return &Poligon{square, FigProps{color, SOLID, false}, Id{0}}
+}
+
+// Draws the handles of drawable, returning the area they cover
+func (doc *Document) ShowHandles(drawable Drawable, active int, out chan chan ColorPoint) image.Rectangle {
+    var covered image.Rectangle
+    handles := Handles(drawable)
+    i := 0
+    for elem := handles.Front(); elem != nil; elem = elem.Next() {
+        p := elem.Value.(image.Point)
+        color := handleColor
+        if i == active { color = activeHandleColor }
+        marker := HandleMarker(p, color)
+        out <- doc.DrawChan(marker)
+        covered = RectUnion(covered, RectExpand(marker.Bounds(), 1))
+        i++
+    }
+    return covered
+}
+
+/* End vertex editing */
+
+/* Transform handles */
+
+const (
+    HANDLE_ROTATE = 8
+    HANDLE_PIVOT = 9
+    ROTATE_HANDLE_DISTANCE = 20
+)
+
+// Corners and middle of the sides of box, clockwise from the top left,
+// then the rotation handle above the box and the pivot
+func BoxHandles(box image.Rectangle, pivot image.Point) *list.List {
+    min := box.Min
+    max := box.Max.Sub(image.Point{1, 1})
+    mid := MidPoint(min, max)
+    handles := new(list.List)
+    handles.PushBack(min)
+    handles.PushBack(image.Point{mid.X, min.Y})
+    handles.PushBack(image.Point{max.X, min.Y})
+    handles.PushBack(image.Point{max.X, mid.Y})
+    handles.PushBack(max)
+    handles.PushBack(image.Point{mid.X, max.Y})
+    handles.PushBack(image.Point{min.X, max.Y})
+    handles.PushBack(image.Point{min.X, mid.Y})
+    handles.PushBack(image.Point{mid.X, min.Y - ROTATE_HANDLE_DISTANCE})
+    handles.PushBack(pivot)
+    return handles
+}
+
+func ListAt(l *list.List, i int) interface{} {
+    elem := l.Front()
+    for ; i > 0 && elem != nil; i-- {
+        elem = elem.Next()
+    }
+    if elem == nil { return nil }
+    return elem.Value
+}
+
+// Scales draws by dragging the scale handle i of box to p, keeping the
+// opposite handle in place
+func ScaleByHandle(draws *list.List, box image.Rectangle, i int, p image.Point) {
+    handles := BoxHandles(box, image.Point{})
+    h := ListAt(handles, i).(image.Point)
+    anchor := ListAt(handles, (i + 4) % 8).(image.Point)
+    sx, sy := 1.0, 1.0
+    // Side handles only scale across their side
+    if i != 1 && i != 5 && h.X != anchor.X {
+        sx = float64(p.X - anchor.X) / float64(h.X - anchor.X)
+    }
+    if i != 3 && i != 7 && h.Y != anchor.Y {
+        sy = float64(p.Y - anchor.Y) / float64(h.Y - anchor.Y)
+    }
+    if sx == 0 || sy == 0 {
+        fmt.Println("Escala nula")
+        return
+    }
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        elem.Value.(Drawable).Scale(anchor, sx, sy)
+    }
+}
+
+// Drags the scale or rotation handle i of the box around draws to p
+func (doc *Document) ApplyHandle(draws *list.List, pivot image.Point, i int, p image.Point) {
+    box := DrawablesBounds(draws)
+    if i == HANDLE_ROTATE {
+        h := ListAt(BoxHandles(box, pivot), HANDLE_ROTATE).(image.Point)
+        angle := doc.ConstrainAngle(Angle(pivot, h, p))
+        for elem := draws.Front(); elem != nil; elem = elem.Next() {
+            elem.Value.(Drawable).RotatePoints(pivot, angle)
+        }
+    } else {
+        ScaleByHandle(draws, box, i, p)
+    }
+}
+
+func DrawablesBounds(draws *list.List) image.Rectangle {
+    var bounds image.Rectangle
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        bounds = RectUnion(bounds, elem.Value.(Drawable).Bounds())
+    }
+    return bounds
+}
+
+// Draws the transformed copies and the handles around them, returning
+// the area they cover
+func (doc *Document) ShowTransform(draws *list.List, pivot image.Point, active int, out chan chan ColorPoint) image.Rectangle {
+    var covered image.Rectangle
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        out <- doc.DrawChan(drawable)
+        covered = RectUnion(covered, Damage(drawable))
+    }
+    handles := BoxHandles(DrawablesBounds(draws), pivot)
+    i := 0
+    for elem := handles.Front(); elem != nil; elem = elem.Next() {
+        color := handleColor
+        if i == active { color = activeHandleColor }
+        marker := HandleMarker(elem.Value.(image.Point), color)
+        out <- doc.DrawChan(marker)
+        covered = RectUnion(covered, RectExpand(marker.Bounds(), 1))
+        i++
+    }
+    return covered
+}
+
+/* End transform handles */
+
+/* Clipboard */
+
+// Distance from the cursor, or from the originals, of pasted objects
+const PASTE_OFFSET = 10
+
+// Objects copied as text. The text is also kept in a file, so other
+// documents and sessions can paste it
+type Clipboard struct {
+    text string
+    path string
+    saved bool // Whether the file has text, as it was last written
+}
+
+var clipboard = &Clipboard{"", os.Getenv("HOME") + "/.godraw_clipboard", false}
+
+func (clip *Clipboard) Write(text string) {
+    clip.text = text
+    err := ioutil.WriteFile(clip.path, []byte(text), 0644)
+    clip.saved = err == nil
+    if err != nil {
+        fmt.Println("Erro ao salvar area de transferencia:", err)
+    }
+}
+
+// The file may have been written later by another session. If saving
+// the last copy failed, the file is older and the copy in memory wins
+func (clip *Clipboard) Read() string {
+    if clip.text != "" && !clip.saved {
+        return clip.text
+    }
+    data, err := ioutil.ReadFile(clip.path)
+    if err != nil {
+        return clip.text
+    }
+    return string(data)
+}
+
+func PointText(p image.Point) string {
+    return fmt.Sprintf("%d %d", p.X, p.Y)
+}
+
+func StyleText(props FigProps) string {
+    thick := 0
+    if props.thick { thick = 1 }
+    c := props.color
+    return fmt.Sprintf("%d %d %d %d %d %d", c.R, c.G, c.B, c.A, props.dotted, thick)
+}
+
+// Text of drawable: its kind, points, parameters and style. Groupings
+// are followed by their members
+func Serialize(drawable Drawable) string {
+    switch d := drawable.(type) {
+    case *Line:
+        return "line " + PointText(d.start) + " " + PointText(d.end) + " " + StyleText(d.FigProps)
+    case *Poligon:
+        text := fmt.Sprint("poligon ", d.points.Len())
+        for elem := d.points.Front(); elem != nil; elem = elem.Next() {
+            text += " " + PointText(elem.Value.(image.Point))
+        }
+        return text + " " + StyleText(d.FigProps)
+    case *RegularPoligon:
+        return "regpol " + PointText(d.origin) + " " + PointText(d.start) + fmt.Sprint(" ", d.sides, " ") + StyleText(d.FigProps)
+    case *Circle:
+        return "circle " + PointText(d.center) + " " + PointText(d.start) + " " + StyleText(d.FigProps)
+    case *CircleArc:
+        return "arc " + PointText(d.center) + " " + PointText(d.start) + fmt.Sprintf(" %f ", d.angle) + StyleText(d.FigProps)
+    case *Grouping:
+        text := fmt.Sprint("group ", d.draws.Len())
+        for elem := d.draws.Front(); elem != nil; elem = elem.Next() {
+            text += "\n" + Serialize(elem.Value.(Drawable))
+        }
+        return text
+    }
+    return ""
+}
+
+func SerializeList(draws *list.List) string {
+    text := ""
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        text += Serialize(elem.Value.(Drawable)) + "\n"
+    }
+    return text
+}
+
+// Reads the fields of serialized objects in order. Once a field is
+// missing or wrong, ok stays false
+type FieldReader struct {
+    fields []string
+    pos int
+    ok bool
+}
+
+func NewFieldReader(text string) *FieldReader {
+    return &FieldReader{strings.Fields(text), 0, true}
+}
+
+func (r *FieldReader) Done() bool {
+    return !r.ok || r.pos >= len(r.fields)
+}
+
+func (r *FieldReader) Word() string {
+    if r.Done() {
+        r.ok = false
+        return ""
+    }
+    r.pos++
+    return r.fields[r.pos-1]
+}
+
+func (r *FieldReader) Float() float64 {
+    value, ok := ParseNumber(r.Word())
+    if !ok { r.ok = false }
+    return value
+}
+
+func (r *FieldReader) Int() int {
+    return Round(r.Float())
+}
+
+func (r *FieldReader) Point() image.Point {
+    x := r.Int()
+    y := r.Int()
+    return image.Point{x, y}
+}
+
+func (r *FieldReader) Style() FigProps {
+    red, green, blue, alpha := r.Int(), r.Int(), r.Int(), r.Int()
+    dotted := r.Int()
+    thick := r.Int() == 1
+    return FigProps{image.RGBAColor{uint8(red), uint8(green), uint8(blue), uint8(alpha)}, dotted, thick}
+}
+
+func Deserialize(r *FieldReader) Drawable {
+    var drawable Drawable
+    switch r.Word() {
+    case "line":
+        start := r.Point()
+        end := r.Point()
+        drawable = &Line{start, end, r.Style(), Id{0}}
+    case "poligon":
+        points := new(list.List)
+        for n := r.Int(); n > 0 && r.ok; n-- {
+            points.PushBack(r.Point())
+        }
+        drawable = &Poligon{points, r.Style(), Id{0}}
+    case "regpol":
+        origin := r.Point()
+        start := r.Point()
+        sides := r.Int()
+        drawable = &RegularPoligon{origin, start, sides, r.Style(), Id{0}}
+    case "circle":
+        center := r.Point()
+        start := r.Point()
+        drawable = &Circle{center, start, r.Style(), Id{0}}
+    case "arc":
+        center := r.Point()
+        start := r.Point()
+        angle := r.Float()
+        drawable = &CircleArc{center, start, angle, r.Style(), Id{0}}
+    case "group":
+        draws := new(list.List)
+        for n := r.Int(); n > 0 && r.ok; n-- {
+            member := Deserialize(r)
+            if member != nil {
+                draws.PushBack(member)
+            }
+        }
+        drawable = &Grouping{draws, Id{0}}
+    default:
+        r.ok = false
+    }
+    if !r.ok {
+        return nil
+    }
+    return drawable
+}
+
+func DeserializeList(text string) (*list.List, bool) {
+    draws := new(list.List)
+    r := NewFieldReader(text)
+    for !r.Done() {
+        drawable := Deserialize(r)
+        if drawable == nil {
+            return draws, false
+        }
+        draws.PushBack(drawable)
+    }
+    return draws, r.ok
+}
+
+// The selection or, with nothing selected, the clicked object
+func (doc *Document) Targets(clickchan <-chan image.Point, kbchan chan int) *list.List {
+    draws := doc.Selected()
+    for draws.Len() == 0 {
+        select {
+        case p := <-clickchan:
+            p = doc.Click(p)
+            drawable, _ := doc.SearchNearPoint(p)
+            if drawable != nil {
+                draws.PushBack(drawable)
+            }
+        case <-kbchan:
+            return draws
+        }
+    }
+    return draws
+}
+
+func (doc *Document) Copy(draws *list.List) {
+    clipboard.Write(SerializeList(draws))
+    fmt.Println(draws.Len(), "objetos copiados")
+}
+
+// Adds copies of draws moved by delta, and selects them
+func (doc *Document) AddCopies(draws *list.List, delta image.Point, out chan chan ColorPoint) {
+    doc.ClearSelection(out)
+    doc.Begin()
+    var damage image.Rectangle
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        drawable.Move(delta)
+        doc.Create(drawable)
+        doc.selection.PushBack(drawable)
+        damage = RectUnion(damage, Damage(drawable))
+    }
+    doc.Commit()
+    doc.Refresh(damage, out)
+}
+
+// Pastes the clipboard with its top left corner near the cursor
+func (doc *Document) Paste(out chan chan ColorPoint) {
+    draws, ok := DeserializeList(clipboard.Read())
+    if !ok {
+        fmt.Println("Area de transferencia invalida")
+        return
+    }
+    if draws.Len() == 0 {
+        fmt.Println("Area de transferencia vazia")
+        return
+    }
+    doc.FlushMotion()
+    at := doc.cursor.Add(image.Point{PASTE_OFFSET, PASTE_OFFSET})
+    doc.AddCopies(draws, at.Sub(DrawablesBounds(draws).Min), out)
+}
+
+func (doc *Document) Duplicate(draws *list.List, out chan chan ColorPoint) {
+    clones := new(list.List)
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        clones.PushBack(elem.Value.(Drawable).Clone())
+    }
+    doc.AddCopies(clones, image.Point{0, 0}, out)
+}
+
+func MovedCopies(draws *list.List, delta image.Point) *list.List {
+    copies := new(list.List)
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        clone := elem.Value.(Drawable).Clone()
+        clone.Move(delta)
+        copies.PushBack(clone)
+    }
+    return copies
+}
+
+// Combines two closed shapes, the two selected or two clicked ones: 'u'
+// union, 'i' intersection, 'd' difference of the first minus the second
+// and 'x' exclusive or. The result takes their place
+func BooleanHandler(doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Operacao booleana: u uniao, i intersecao, d diferenca, x ou exclusivo")
+    var op int
+    switch <-kbchan {
+    case 'u':
+        op = BOOL_UNION
+    case 'i':
+        op = BOOL_INTERSECTION
+    case 'd':
+        op = BOOL_DIFFERENCE
+    case 'x':
+        op = BOOL_XOR
+    default:
+        return
+    }
+    draws := doc.SelectedEditables()
+    if draws.Len() != 2 {
+        draws = new(list.List)
+        for draws.Len() < 2 {
+            select {
+            case p := <-clickchan:
+                p = doc.Click(p)
+                drawable, _ := doc.SearchNearPoint(p)
+                if drawable != nil && doc.Editable(drawable) && !ListContains(draws, drawable) {
+                    draws.PushBack(drawable)
+                }
+            case <-kbchan:
+                return
+            }
+        }
+    }
+    first := draws.Front().Value.(Drawable)
+    second := draws.Back().Value.(Drawable)
+    a, ok := ClosedPath(first)
+    b, ok2 := ClosedPath(second)
+    if !ok || !ok2 {
+        fmt.Println("Apenas poligonos, poligonos regulares e circulos")
+        return
+    }
+    paths := BooleanPaths(a, b, op)
+    if paths.Len() == 0 {
+        fmt.Println("Resultado vazio")
+        return
+    }
+    props := FigProps{doc.style.color, doc.style.dotted, doc.style.thick}
+    if poligon, ok := first.(*Poligon); ok { props = poligon.FigProps }
+    if regpol, ok := first.(*RegularPoligon); ok { props = regpol.FigProps }
+    if circle, ok := first.(*Circle); ok { props = circle.FigProps }
+    result := BooleanResult(paths, props)
+    doc.Begin()
+    doc.Delete(first, out)
+    doc.Delete(second, out)
+    doc.Add(result, out)
+    doc.Commit()
+}
+
+// Replicates the selection, or the clicked object. 'l' makes a row of
+// copies at a fixed offset, 'g' a grid of rows and columns and 'p' copies
+// rotated about a center along a total angle. The copies may be grouped
+func ArrayHandler(doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Copias em serie")
+    draws := doc.Targets(clickchan, kbchan)
+    if draws.Len() == 0 { return }
+    fmt.Println("l: linear, g: grade, p: polar")
+    copies := new(list.List)
+    switch <-kbchan {
+    case 'l':
+        fmt.Println("Numero de copias:")
+        n, ok := doc.NextNumber(clickchan, kbchan)
+        if !ok { return }
+        fmt.Println("Deslocamento entre copias (dois pontos):")
+        delta, ok := doc.NextVector(clickchan, kbchan)
+        if !ok { return }
+        for i := 1; i <= int(n); i++ {
+            copies.PushBackList(MovedCopies(draws, image.Point{delta.X * i, delta.Y * i}))
+        }
+    case 'g':
+        fmt.Println("Linhas:")
+        rows, ok := doc.NextNumber(clickchan, kbchan)
+        if !ok { return }
+        fmt.Println("Colunas:")
+        cols, ok := doc.NextNumber(clickchan, kbchan)
+        if !ok { return }
+        fmt.Println("Espacamento, x entre colunas e y entre linhas (dois pontos):")
+        delta, ok := doc.NextVector(clickchan, kbchan)
+        if !ok { return }
+        for r := 0; r < int(rows); r++ {
+            for c := 0; c < int(cols); c++ {
+                if r == 0 && c == 0 { continue }
+                copies.PushBackList(MovedCopies(draws, image.Point{delta.X * c, delta.Y * r}))
+            }
+        }
+    case 'p':
+        fmt.Println("Numero de copias:")
+        n, ok := doc.NextNumber(clickchan, kbchan)
+        if !ok || n < 1 { return }
+        fmt.Println("Centro:")
+        center, ok := doc.NextPoint(clickchan, kbchan, nil)
+        if !ok { return }
+        fmt.Println("Angulo total:")
+        total, ok := doc.NextNumber(clickchan, kbchan)
+        if !ok { return }
+        // Around the whole circle the last copy must not cover the original
+        step := total / n
+        if math.Fabs(total) >= 360 {
+            step = total / (n + 1)
+        }
+        for i := 1; i <= int(n); i++ {
+            rotated := MovedCopies(draws, image.Point{0, 0})
+            for elem := rotated.Front(); elem != nil; elem = elem.Next() {
+                // Counterclockwise, as typed angles
+                elem.Value.(Drawable).RotatePoints(center, -step * float64(i) * math.Pi / 180)
+            }
+            copies.PushBackList(rotated)
+        }
+    default:
+        return
+    }
+    if copies.Len() == 0 { return }
+    fmt.Println("g: agrupar as copias, outra tecla: nao agrupar")
+    group := <-kbchan == 'g'
+    doc.Begin()
+    var damage image.Rectangle
+    if group {
+        grouping := &Grouping{copies, Id{doc.NewId()}}
+        doc.Create(grouping)
+        damage = Damage(grouping)
+    } else {
+        for elem := copies.Front(); elem != nil; elem = elem.Next() {
+            doc.Create(elem.Value.(Drawable))
+            damage = RectUnion(damage, Damage(elem.Value.(Drawable)))
+        }
+    }
+    doc.Commit()
+    doc.Refresh(damage, out)
+    fmt.Println(copies.Len(), "copias")
+}
+
+func ClipboardHandler(doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint, key int) {
+    switch key {
+    case 'C':
+        fmt.Println("Copiar")
+        doc.Copy(doc.Targets(clickchan, kbchan))
+    case 'X':
+        fmt.Println("Recortar")
+        // Locked objects stay where they are, and out of the clipboard
+        draws := new(list.List)
+        targets := doc.Targets(clickchan, kbchan)
+        for elem := targets.Front(); elem != nil; elem = elem.Next() {
+            if doc.Editable(elem.Value.(Drawable)) {
+                draws.PushBack(elem.Value)
+            }
+        }
+        if draws.Len() == 0 { return }
+        doc.Copy(draws)
+        doc.Begin()
+        for elem := draws.Front(); elem != nil; elem = elem.Next() {
+            doc.Delete(elem.Value.(Drawable), out)
+        }
+        doc.Commit()
+    case 'V':
+        fmt.Println("Colar")
+        doc.Paste(out)
+    case 'D':
+        fmt.Println("Duplicar")
+        doc.Duplicate(doc.Targets(clickchan, kbchan), out)
+    }
+}
+
+/* End clipboard */
+
+/* Layers */
+
+type Layer struct {
+    name string
+    drawables *list.List // In z-order, the top last
+    visible bool
+    locked bool
+}
+
+func NewLayer(name string) *Layer {
+    return &Layer{name, new(list.List), true, false}
+}
+
+// The layer holding drawable and its element there
+func (doc *Document) LayerOf(drawable Drawable) (*Layer, *list.Element) {
+    for l := doc.layers.Front(); l != nil; l = l.Next() {
+        layer := l.Value.(*Layer)
+        for elem := layer.drawables.Front(); elem != nil; elem = elem.Next() {
+            if elem.Value.(Drawable) == drawable {
+                return layer, elem
+            }
+        }
+    }
+    return nil, nil
+}
+
+// Whether drawable may be moved, rotated, mirrored or deleted
+func (doc *Document) Editable(drawable Drawable) bool {
+    layer, _ := doc.LayerOf(drawable)
+    if layer != nil && layer.locked {
+        fmt.Println("Camada bloqueada:", layer.name)
+        return false
+    }
+    return true
+}
+
+func (doc *Document) AddLayer(name string) *Layer {
+    layer := NewLayer(name)
+    doc.layers.PushBack(layer)
+    return layer
+}
+
+// Puts drawable on top of layer, if it may be changed and the layer
+// is visible and unlocked
+func (doc *Document) MoveToLayer(drawable Drawable, layer *Layer, out chan chan ColorPoint) {
+    old, _ := doc.LayerOf(drawable)
+    if old == nil || old == layer { return }
+    if !doc.Editable(drawable) { return }
+    if layer.locked {
+        fmt.Println("Camada bloqueada:", layer.name)
+        return
+    }
+    if !layer.visible {
+        fmt.Println("Camada oculta:", layer.name)
+        return
+    }
+    _, pos := doc.PositionOf(drawable)
+    op := &LayerOp{drawable, old, pos, layer}
+    op.Redo(doc, out)
+    doc.Record(op)
+}
+
+func (doc *Document) PrintLayers() {
+    i := 1
+    for l := doc.layers.Front(); l != nil; l = l.Next() {
+        layer := l.Value.(*Layer)
+        flags := ""
+        if layer == doc.active { flags += " (ativa)" }
+        if !layer.visible { flags += " (oculta)" }
+        if layer.locked { flags += " (bloqueada)" }
+        fmt.Println(i, layer.name, layer.drawables.Len(), "objetos" + flags)
+        i++
+    }
+}
+
+func (doc *Document) LayerAt(n int) *Layer {
+    i := 1
+    for l := doc.layers.Front(); l != nil; l = l.Next() {
+        if i == n {
+            return l.Value.(*Layer)
+        }
+        i++
+    }
+    return nil
+}
+
+/* End layers */
+
+/* Display list */
+
+// Repaints rect of the screen from the objects: the background, the
+// drawables from the bottom up, with their copies in the windows, the
+// marks of the selection and the borders of the windows
+func (doc *Document) Render(rect image.Rectangle) chan ColorPoint {
+    out := make(chan ColorPoint, BUF_SIZE)
+    rect = RectIntersect(rect, screenRect)
+    query := doc.index.Query(rect)
+    windows := new(list.List)
+    for elem := doc.windows.Front(); elem != nil; elem = elem.Next() {
+        window := elem.Value.(Window)
+        if RectOverlaps(rect, window.TargetRect()) {
+            query.PushBackList(doc.index.Query(window.SourceRect()))
+        }
+        windows.PushBack(window)
+    }
+    draws := doc.ZOrdered(query)
+    boxes := new(list.List)
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        if doc.IsSelected(elem.Value.(Drawable)) {
+            boxes.PushBackList(SelectionBox(elem.Value.(Drawable)))
+        }
+    }
+    draws.PushBackList(boxes)
+    background := doc.Background()
+    paint := doc.Painter()
+    go func() {
+        for x := rect.Min.X; x < rect.Max.X; x++ {
+            for y := rect.Min.Y; y < rect.Max.Y; y++ {
+                out <- background(image.Point{x, y})
+            }
+        }
+        for elem := draws.Front(); elem != nil; elem = elem.Next() {
+            in := paint(elem.Value.(Drawable))
+            for ! closed(in) {
+                cp := <-in
+                if PointInRect(cp.point, rect) {
+                    out <- cp
+                }
+            }
+        }
+        for elem := windows.Front(); elem != nil; elem = elem.Next() {
+            in := elem.Value.(Window).PointChan()
+            for ! closed(in) {
+                cp := <-in
+                if PointInRect(cp.point, rect) {
+                    out <- cp
+                }
+            }
+        }
+        close(out)
+    }()
+    return out
+}
+
+// Repaints rect of the drawing and its magnified copies
+func (doc *Document) Refresh(rect image.Rectangle, out chan chan ColorPoint) {
+    out <- doc.Render(rect)
+    for elem := doc.windows.Front(); elem != nil; elem = elem.Next() {
+        window := elem.Value.(Window)
+        source := RectIntersect(rect, window.SourceRect())
+        if source.Dx() > 0 {
+            out <- doc.Render(RectExpand(window.TransferRect(source), int(math.Ceil(window.zoom)) + 1))
+        }
+    }
+}
+
+/* End display list */
+
+/* Hit testing */
+
+type Hit struct {
+    drawable Drawable
+    point image.Point // Closest point of the object
+    dist float64
+    z int
+    interior bool
+}
+
+// Objects whose stroke is within SEARCH_RADIUS of point, from the top
+// down and then by distance, followed by the closed shapes containing
+// it
+func (doc *Document) HitTest(point image.Point) []Hit {
+    candidates := new(list.List)
+    z := 0
+    near := image.Rect(point.X - SEARCH_RADIUS, point.Y - SEARCH_RADIUS, point.X + SEARCH_RADIUS + 1, point.Y + SEARCH_RADIUS + 1)
+    draws := doc.ZOrdered(doc.index.Query(near))
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        closest := drawable.ClosestPoint(point)
+        dist := PointsDistance(point, closest)
+        if dist <= SEARCH_RADIUS {
+            candidates.PushBack(Hit{drawable, closest, dist, z, false})
+        } else if drawable.Contains(point) {
+            candidates.PushBack(Hit{drawable, point, dist, z, true})
+        }
+        z++
+    }
+    hits := make([]Hit, candidates.Len())
+    i := 0
+    for elem := candidates.Front(); elem != nil; elem = elem.Next() {
+        hit := elem.Value.(Hit)
+        j := i
+        for ; j > 0 && hit.Before(hits[j-1]); j-- {
+            hits[j] = hits[j-1]
+        }
+        hits[j] = hit
+        i++
+    }
+    return hits
+}
+
+func (hit Hit) Before(other Hit) bool {
+    if hit.interior != other.interior {
+        return !hit.interior
+    }
+    if hit.z != other.z {
+        return hit.z > other.z
+    }
+    return hit.dist < other.dist
+}
+
+// Even-odd rule on a closed path
+func PathContains(points *list.List, p image.Point) bool {
+    inside := false
+    px, py := float64(p.X), float64(p.Y)
+    segments := PathSegments(points)
+    for elem := segments.Front(); elem != nil; elem = elem.Next() {
+        a, b := elem.Value.(Segment).start, elem.Value.(Segment).end
+        if (a.Y > p.Y) != (b.Y > p.Y) {
+            x := float64(a.X) + (py - float64(a.Y)) * float64(b.X - a.X) / float64(b.Y - a.Y)
+            if px < x {
+                inside = !inside
+            }
+        }
+    }
+    return inside
+}
+
+// Picks the object under point. Clicking again on the same spot cycles
+// through the overlapping objects
+func (doc *Document) SearchNearPoint(point image.Point) (Drawable, image.Point) {
+    hits := doc.HitTest(point)
+    if len(hits) == 0 {
+        fmt.Println("Objeto nao encontrado")
+        doc.ResetHitCycle()
+        return nil, point
+    }
+    if PointsDistance(point, doc.lastHitPoint) <= 2 {
+        doc.lastHitIndex = (doc.lastHitIndex + 1) % len(hits)
+    } else {
+        doc.lastHitIndex = 0
+    }
+    doc.lastHitPoint = point
+    if len(hits) > 1 {
+        fmt.Println("Objeto", doc.lastHitIndex + 1, "de", len(hits))
+    }
+    hit := hits[doc.lastHitIndex]
+    return hit.drawable, hit.point
+}
+
+// The next click starts again from the top object. Cycling only holds
+// within a command, while the drawing stays the same
+func (doc *Document) ResetHitCycle() {
+    doc.lastHitPoint = image.Point{-1, -1}
+    doc.lastHitIndex = 0
+}
+
+/* End hit testing */
+
+/* Functions for the list of objects */
+
+// Adds drawable on top of the active layer, giving it an id if it has
+// none (as clones)
+func (doc *Document) Register(drawable Drawable) {
+    if drawable.GetId() == 0 {
+        drawable.SetId(doc.NewId())
+    }
+    doc.active.drawables.PushBack(drawable)
+    doc.index.Insert(drawable)
+}
+
+// Registers a new object as one that can be undone, and paints it in
+// the drawing and in the windows showing it
+func (doc *Document) Add(drawable Drawable, out chan chan ColorPoint) {
+    doc.Create(drawable)
+    doc.Refresh(Damage(drawable), out)
+}
+
+// Same as Add, without painting, for many objects repainted at once
+func (doc *Document) Create(drawable Drawable) {
+    doc.Register(drawable)
+    doc.Record(&CreateOp{drawable, doc.active})
+}
+
+// Puts drawable back at pos of layer, or on top if pos < 0
+func (doc *Document) Restore(drawable Drawable, layer *Layer, pos int, out chan chan ColorPoint) {
+    elem := layer.drawables.Front()
+    for i := 0; i < pos && elem != nil; i++ {
+        elem = elem.Next()
+    }
+    if pos < 0 || elem == nil {
+        layer.drawables.PushBack(drawable)
+    } else {
+        layer.drawables.InsertBefore(drawable, elem)
+    }
+    doc.index.Insert(drawable)
+    doc.Refresh(Damage(drawable), out)
+}
+
+// Puts replacement in the place current has in the stacking order
+func (doc *Document) Swap(current Drawable, replacement Drawable, out chan chan ColorPoint) {
+    layer, elem := doc.LayerOf(current)
+    if layer == nil { return }
+    layer.drawables.InsertAfter(replacement, elem)
+    layer.drawables.Remove(elem)
+    for sel := doc.selection.Front(); sel != nil; sel = sel.Next() {
+        if sel.Value.(Drawable) == current {
+            sel.Value = replacement
+        }
+    }
+    doc.index.Remove(current)
+    doc.index.Insert(replacement)
+    doc.Refresh(Damage(current), out)
+    doc.Refresh(Damage(replacement), out)
+}
+
+func (doc *Document) Replace(current Drawable, replacement Drawable, out chan chan ColorPoint) {
+    doc.Swap(current, replacement, out)
+    doc.Record(&ReplaceOp{current, replacement})
+}
+
+func (doc *Document) Unregister(drawable Drawable) {
+    doc.index.Remove(drawable)
+    layer, elem := doc.LayerOf(drawable)
+    if layer != nil {
+        layer.drawables.Remove(elem)
+    }
+}
+
+// Updates the index after drawable changed in place
+func (doc *Document) Reindex(drawable Drawable) {
+    doc.index.Remove(drawable)
+    doc.index.Insert(drawable)
+}
+
+// Repaints drawable after it changed in place, keeping its place in
+// the stacking order. old are its bounds before the change
+func (doc *Document) Update(drawable Drawable, old image.Rectangle, out chan chan ColorPoint) {
+    doc.Reindex(drawable)
+    doc.Refresh(RectExpand(old, SELECTION_MARGIN + 1), out)
+    doc.Refresh(Damage(drawable), out)
+}
+
+// The drawables of the list in visible layers, sorted from the bottom
+// to the top
+func (doc *Document) ZOrdered(draws *list.List) *list.List {
+    set := make(map[Drawable]bool)
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        set[elem.Value.(Drawable)] = true
+    }
+    sorted := new(list.List)
+    for l := doc.layers.Front(); l != nil; l = l.Next() {
+        layer := l.Value.(*Layer)
+        if !layer.visible { continue }
+        for elem := layer.drawables.Front(); elem != nil; elem = elem.Next() {
+            if set[elem.Value.(Drawable)] {
+                sorted.PushBack(elem.Value)
+            }
+        }
+    }
+    return sorted
+}
+
+/* End functions for the list of objects */
+
+/* Stacking order, inside the layer of each object */
+
+// Puts drawable just above the next object that overlaps it. Objects
+// that don't overlap it would not show the change
+func (doc *Document) Raise(drawable Drawable) bool {
+    layer, elem := doc.LayerOf(drawable)
+    if elem == nil { return false }
+    bounds := RectExpand(drawable.Bounds(), 1)
+    for next := elem.Next(); next != nil; next = next.Next() {
+        if RectOverlaps(bounds, next.Value.(Drawable).Bounds()) {
+            layer.drawables.Remove(elem)
+            layer.drawables.InsertAfter(drawable, next)
+            return true
+        }
+    }
+    return false
+}
+
+// Puts drawable just below the previous object that overlaps it
+func (doc *Document) Lower(drawable Drawable) bool {
+    layer, elem := doc.LayerOf(drawable)
+    if elem == nil { return false }
+    bounds := RectExpand(drawable.Bounds(), 1)
+    for prev := elem.Prev(); prev != nil; prev = prev.Prev() {
+        if RectOverlaps(bounds, prev.Value.(Drawable).Bounds()) {
+            layer.drawables.Remove(elem)
+            layer.drawables.InsertBefore(drawable, prev)
+            return true
+        }
+    }
+    return false
+}
+
+func (doc *Document) BringToFront(drawable Drawable) bool {
+    layer, elem := doc.LayerOf(drawable)
+    if elem == nil || elem.Next() == nil { return false }
+    layer.drawables.MoveToBack(elem)
+    return true
+}
+
+func (doc *Document) SendToBack(drawable Drawable) bool {
+    layer, elem := doc.LayerOf(drawable)
+    if elem == nil || elem.Prev() == nil { return false }
+    layer.drawables.MoveToFront(elem)
+    return true
+}
+
+// Layer of drawable and its place in it, from the bottom
+func (doc *Document) PositionOf(drawable Drawable) (*Layer, int) {
+    layer, elem := doc.LayerOf(drawable)
+    if layer == nil { return nil, -1 }
+    pos := 0
+    for e := layer.drawables.Front(); e != elem; e = e.Next() {
+        pos++
+    }
+    return layer, pos
+}
+
+/* End stacking order */
+
+/* Spatial index */
+
+const (
+    QUAD_CAPACITY = 8 // Items in a node before it splits
+    QUAD_MIN_SIZE = 32
+    QUAD_INITIAL_SIZE = 1024
+)
+
+type QuadItem struct {
+    drawable Drawable
+    bounds image.Rectangle
+}
+
+// Each item is kept in the smallest node that contains its bounds
+type QuadNode struct {
+    bounds image.Rectangle
+    items *list.List
+    children []*QuadNode // nil for leaves
+}
+
+// Quadtree of the bounding boxes of the objects. The root grows to fit
+// whatever is inserted, so the canvas has no limits
+type QuadTree struct {
+    root *QuadNode
+}
+
+func NewQuadTree() *QuadTree {
+    return &QuadTree{NewQuadNode(image.Rect(0, 0, QUAD_INITIAL_SIZE, QUAD_INITIAL_SIZE))}
+}
+
+func NewQuadNode(bounds image.Rectangle) *QuadNode {
+    return &QuadNode{bounds, new(list.List), nil}
+}
+
+func RectOverlaps(r1 image.Rectangle, r2 image.Rectangle) bool {
+    return r1.Min.X < r2.Max.X && r2.Min.X < r1.Max.X &&
+           r1.Min.Y < r2.Max.Y && r2.Min.Y < r1.Max.Y
+}
+
+func RectContains(outer image.Rectangle, inner image.Rectangle) bool {
+    return inner.Min.X >= outer.Min.X && inner.Min.Y >= outer.Min.Y &&
+           inner.Max.X <= outer.Max.X && inner.Max.Y <= outer.Max.Y
+}
+
+func (tree *QuadTree) Insert(drawable Drawable) {
+    bounds := drawable.Bounds()
+    for !RectContains(tree.root.bounds, bounds) && bounds.Dx() > 0 && bounds.Dy() > 0 {
+        tree.Grow(bounds)
+    }
+    tree.root.Insert(QuadItem{drawable, bounds})
+}
+
+// Doubles the root towards bounds, the old root becoming a quadrant
+func (tree *QuadTree) Grow(bounds image.Rectangle) {
+    old := tree.root
+    grown := old.bounds
+    if bounds.Min.X < old.bounds.Min.X {
+        grown.Min.X -= old.bounds.Dx()
+    } else {
+        grown.Max.X += old.bounds.Dx()
+    }
+    if bounds.Min.Y < old.bounds.Min.Y {
+        grown.Min.Y -= old.bounds.Dy()
+    } else {
+        grown.Max.Y += old.bounds.Dy()
+    }
+    tree.root = NewQuadNode(grown)
+    tree.root.Split()
+    for i, child := range tree.root.children {
+        if child.bounds == old.bounds {
+            tree.root.children[i] = old
+        }
+    }
+}
+
+func (tree *QuadTree) Remove(drawable Drawable) {
+    // The bounds may have changed since the insertion
+    if !tree.root.Remove(drawable, drawable.Bounds()) {
+        tree.root.Remove(drawable, tree.root.bounds)
+    }
+}
+
+// Drawables whose bounds overlap rect
+func (tree *QuadTree) Query(rect image.Rectangle) *list.List {
+    found := new(list.List)
+    tree.root.Query(rect, found)
+    return found
+}
+
+func (node *QuadNode) Split() {
+    min := node.bounds.Min
+    mid := RectCenter(node.bounds)
+    max := node.bounds.Max
+    node.children = []*QuadNode{
+        NewQuadNode(image.Rect(min.X, min.Y, mid.X, mid.Y)),
+        NewQuadNode(image.Rect(mid.X, min.Y, max.X, mid.Y)),
+        NewQuadNode(image.Rect(min.X, mid.Y, mid.X, max.Y)),
+        NewQuadNode(image.Rect(mid.X, mid.Y, max.X, max.Y)),
+    }
+}
+
+func (node *QuadNode) ChildFor(bounds image.Rectangle) *QuadNode {
+    for _, child := range node.children {
+        if RectContains(child.bounds, bounds) {
+            return child
+        }
+    }
+    return nil
+}
+
+func (node *QuadNode) Insert(item QuadItem) {
+    if node.children != nil {
+        child := node.ChildFor(item.bounds)
+        if child != nil {
+            child.Insert(item)
+            return
+        }
+    }
+    node.items.PushBack(item)
+    if node.children == nil && node.items.Len() > QUAD_CAPACITY && node.bounds.Dx() > QUAD_MIN_SIZE {
+        node.Split()
+        items := node.items
+        node.items = new(list.List)
+        for elem := items.Front(); elem != nil; elem = elem.Next() {
+            node.Insert(elem.Value.(QuadItem))
+        }
+    }
+}
+
+func (node *QuadNode) Remove(drawable Drawable, bounds image.Rectangle) bool {
+    for elem := node.items.Front(); elem != nil; elem = elem.Next() {
+        if elem.Value.(QuadItem).drawable == drawable {
+            node.items.Remove(elem)
+            return true
+        }
+    }
+    for _, child := range node.children {
+        if RectOverlaps(child.bounds, bounds) && child.Remove(drawable, bounds) {
+            return true
+        }
+    }
+    return false
+}
+
+func (node *QuadNode) Query(rect image.Rectangle, found *list.List) {
+    for elem := node.items.Front(); elem != nil; elem = elem.Next() {
+        item := elem.Value.(QuadItem)
+        if RectOverlaps(item.bounds, rect) {
+            found.PushBack(item.drawable)
+        }
+    }
+    for _, child := range node.children {
+        if RectOverlaps(child.bounds, rect) {
+            child.Query(rect, found)
+        }
+    }
+}
+
+/* End spatial index */
+
+/* Helper functions for image.Point */
+
+func PointsDistance(p1 image.Point, p2 image.Point) float64 {
+    return math.Sqrt(math.Pow(float64(p1.X - p2.X), 2) + math.Pow(float64(p1.Y - p2.Y), 2))
+}
+
+func Angle (origin image.Point, point1 image.Point, point2 image.Point) float64 {
+    // radius1 := point1.Sub(origin)
+    // ang1    := math.Atan(float64(int(radius1.Y))/float64(int(radius1.X)))
+    // if radius1.X < 0 { ang1 -= math.Pi }
+    // radius2 := point2.Sub(origin)
+    // ang2    := math.Atan(float64(int(radius2.Y))/float64(int(radius2.X)))
+    // if radius2.X < 0 { ang2 -= math.Pi }
+    return Theta(point2.Sub(origin))-Theta(point1.Sub(origin))
+}
+
+func Theta(vector image.Point) float64{
+    // ang := math.Atan(float64(int(vector.Y))/float64(int(vector.X)))
+    // if vector.X < 0 { ang -= math.Pi }
+    return math.Atan2(float64(int(vector.Y)), float64(int(vector.X)))
+}
+
+func RotatePoint(point image.Point, origin image.Point, angle float64) image.Point {
+    delta := point.Sub(origin)
+    x := float64(int(delta.X))*math.Cos(angle) - float64(int(delta.Y))*math.Sin(angle)
+    y := float64(int(delta.X))*math.Sin(angle) + float64(int(delta.Y))*math.Cos(angle)
+    return image.Point{int(float64(x)), int(float64(y))}.Add(origin)
+}
+
+func ScalePoint(point image.Point, origin image.Point, sx float64, sy float64) image.Point {
+    delta := point.Sub(origin)
+    return image.Point{Round(float64(delta.X) * sx), Round(float64(delta.Y) * sy)}.Add(origin)
+}
+
+// Scales a round shape keeping it round, by the mean of both factors
+func ScaleRound(center *image.Point, start *image.Point, origin image.Point, sx float64, sy float64) {
+    k := math.Sqrt(math.Fabs(sx * sy))
+    delta := start.Sub(*center)
+    *center = ScalePoint(*center, origin, sx, sy)
+    *start = center.Add(image.Point{Round(float64(delta.X) * k), Round(float64(delta.Y) * k)})
+}
+
+func Round(x float64) int {
+    return int(math.Floor(x + 0.5))
+}
+
+func MidPoint(p1 image.Point, p2 image.Point) image.Point {
+    return image.Point{(p1.X + p2.X)/2, (p1.Y + p2.Y)/2}
+}
+
+// Closest point to p on the segment from a to b
+func ClosestPointOnSegment(p image.Point, a image.Point, b image.Point) (float64, float64) {
+    ax, ay := float64(a.X), float64(a.Y)
+    dx, dy := float64(b.X - a.X), float64(b.Y - a.Y)
+    length := dx*dx + dy*dy
+    if length == 0 {
+        return ax, ay
+    }
+    t := ((float64(p.X) - ax)*dx + (float64(p.Y) - ay)*dy) / length
+    if t < 0 { t = 0 }
+    if t > 1 { t = 1 }
+    return ax + t*dx, ay + t*dy
+}
+
+/* End helper functions for image.Point */
+
+/* Angle constraint */
+
+// Rounds the angle to a multiple of doc.angleStep, if constrained
+func (doc *Document) ConstrainAngle(angle float64) float64 {
+    if !doc.angleConstraint {
+        return angle
+    }
+    step := float64(doc.angleStep) * math.Pi / 180
+    return math.Floor(angle/step + 0.5) * step
+}
+
+// Moves point so the direction from origin is constrained, keeping its
+// projection on that direction
+func (doc *Document) ConstrainPoint(origin image.Point, point image.Point) image.Point {
+    if !doc.angleConstraint || point == origin {
+        return point
+    }
+    return ProjectPoint(origin, point, doc.ConstrainAngle(Theta(point.Sub(origin))))
+}
+
+// Projects point on the ray from origin with direction theta
+func ProjectPoint(origin image.Point, point image.Point, theta float64) image.Point {
+    delta := point.Sub(origin)
+    length := float64(delta.X)*math.Cos(theta) + float64(delta.Y)*math.Sin(theta)
+    return origin.Add(image.Point{Round(length*math.Cos(theta)), Round(length*math.Sin(theta))})
+}
+
+/* End angle constraint */
+
+/* Typed input */
+
+const (
+    INPUT_POINT = 0
+    INPUT_NUMBER = 1
+    INPUT_ANGLE = 2
+    INPUT_CANCEL = 3
+)
+
+// A point, a number or an angle lock, clicked or typed
+type Input struct {
+    kind int
+    point image.Point
+    value float64
+}
+
+// Keys that start typed input instead of cancelling a handler
+func IsInputKey(key int) bool {
+    if key >= '0' && key <= '9' { return true }
+    return key == '@' || key == '<' || key == '-' || key == '.'
+}
+
+// Reads text from the keyboard, starting with the key first, until
+// Return. Escape discards it
+func ReadInput(first int, kbchan chan int) (string, bool) {
+    text := ""
+    for key := first; ; key = <-kbchan {
+        switch key {
+        case KEY_RETURN, '\r', '\n':
+            return text, true
+        case KEY_ESCAPE, 27:
+            fmt.Println("Entrada cancelada")
+            return "", false
+        case KEY_BACKSPACE, 8:
+            if len(text) > 0 {
+                text = text[0:len(text)-1]
+            }
+        default:
+            if key > ' ' && key < 127 {
+                text += string([]byte{byte(key)})
+            }
+        }
+        fmt.Println("Entrada:", text)
+    }
+    return text, true
+}
+
+func ParseNumber(text string) (float64, bool) {
+    if len(text) == 0 {
+        return 0, false
+    }
+    sign := 1.0
+    i := 0
+    if text[0] == '-' {
+        sign = -1
+        i++
+    }
+    value := 0.0
+    frac := 1.0
+    dot := false
+    digits := 0
+    for ; i < len(text); i++ {
+        c := text[i]
+        if c == '.' && !dot {
+            dot = true
+            continue
+        }
+        if c < '0' || c > '9' {
+            return 0, false
+        }
+        if dot {
+            frac /= 10
+            value += float64(c - '0') * frac
+        } else {
+            value = value*10 + float64(c - '0')
+        }
+        digits++
+    }
+    return sign*value, digits > 0
+}
+
+// Accepts "x,y", "d<a" (polar), "@dx,dy" and "@d<a" (relative to the
+// last point), "<a" (locks the angle of the next click) or a number.
+// Angles are in degrees, counterclockwise
+func (doc *Document) ParseInput(text string) (Input, bool) {
+    base := image.Point{0, 0}
+    relative := false
+    if len(text) > 0 && text[0] == '@' {
+        base = doc.lastPoint
+        relative = true
+        text = text[1:]
+    }
+    if i := strings.Index(text, "<"); i >= 0 {
+        angle, ok := ParseNumber(text[i+1:])
+        if !ok {
+            return Input{}, false
+        }
+        theta := -angle * math.Pi / 180
+        if i == 0 {
+            return Input{INPUT_ANGLE, doc.lastPoint, theta}, true
+        }
+        dist, ok := ParseNumber(text[0:i])
+        if !ok {
+            return Input{}, false
+        }
+        delta := image.Point{Round(dist*math.Cos(theta)), Round(dist*math.Sin(theta))}
+        return Input{INPUT_POINT, base.Add(delta), 0}, true
+    }
+    if i := strings.Index(text, ","); i >= 0 {
+        x, okx := ParseNumber(text[0:i])
+        y, oky := ParseNumber(text[i+1:])
+        if !okx || !oky {
+            return Input{}, false
+        }
+        return Input{INPUT_POINT, base.Add(image.Point{Round(x), Round(y)}), 0}, true
+    }
+    value, ok := ParseNumber(text)
+    if !ok || relative {
+        return Input{}, false
+    }
+    return Input{INPUT_NUMBER, doc.lastPoint, value}, true
+}
+
+// Waits for a click or typed input. Clicks are angle constrained
+// from the point from, if any. Other keys cancel
+func (doc *Document) NextInput(clickchan <-chan image.Point, kbchan chan int, from *image.Point) Input {
+    locked := false
+    var theta float64
+    for {
+        select {
+        case p := <-clickchan:
+            p = doc.Click(p)
+            if locked {
+                p = ProjectPoint(doc.lastPoint, p, theta)
+            } else if from != nil {
+                p = doc.ConstrainPoint(*from, p)
+            }
+            doc.lastPoint = p
+            return Input{INPUT_POINT, p, 0}
+        case event := <-doc.motion:
+            p := doc.Motion(event)
+            if locked {
+                p = ProjectPoint(doc.lastPoint, p, theta)
+            } else if from != nil {
+                p = doc.ConstrainPoint(*from, p)
+            }
+            doc.ShowPreview(p)
+        case key := <-kbchan:
+            if !IsInputKey(key) {
+                return Input{INPUT_CANCEL, doc.lastPoint, 0}
+            }
+            text, ok := ReadInput(key, kbchan)
+            if !ok {
+                continue
+            }
+            input, ok := doc.ParseInput(text)
+            if !ok {
+                fmt.Println("Entrada invalida:", text)
+                continue
+            }
+            switch input.kind {
+            case INPUT_ANGLE:
+                locked = true
+                theta = input.value
+                fmt.Println("Angulo travado:", -theta * 180 / math.Pi)
+                continue
+            case INPUT_POINT:
+                doc.lastPoint = input.point
+                fmt.Println("Ponto:", input.point)
+            }
+            return input
+        }
+    }
+    return Input{INPUT_CANCEL, doc.lastPoint, 0}
+}
+
+// Like NextInput, but only accepts points
+func (doc *Document) NextPoint(clickchan <-chan image.Point, kbchan chan int, from *image.Point) (image.Point, bool) {
+    for {
+        input := doc.NextInput(clickchan, kbchan, from)
+        switch input.kind {
+        case INPUT_POINT:
+            return input.point, true
+        case INPUT_CANCEL:
+            return input.point, false
+        }
+        fmt.Println("Esperado um ponto")
+    }
+    return doc.lastPoint, false
+}
+
+// Like NextInput, but only accepts numbers
+func (doc *Document) NextNumber(clickchan <-chan image.Point, kbchan chan int) (float64, bool) {
+    for {
+        input := doc.NextInput(clickchan, kbchan, nil)
+        switch input.kind {
+        case INPUT_NUMBER:
+            return input.value, true
+        case INPUT_CANCEL:
+            return 0, false
+        }
+        fmt.Println("Esperado um numero")
+    }
+    return 0, false
+}
+
+// Vector between two points, the second one may be typed as "@dx,dy"
+func (doc *Document) NextVector(clickchan <-chan image.Point, kbchan chan int) (image.Point, bool) {
+    base, ok := doc.NextPoint(clickchan, kbchan, nil)
+    if !ok {
+        return base, false
+    }
+    p, ok := doc.NextPoint(clickchan, kbchan, &base)
+    return p.Sub(base), ok
+}
+
+/* End typed input */
+
+/* Previews */
+
+// Shows the shape made by shape for the mouse position while waiting for
+// input, until ClearPreview. The shape is not part of the drawing
+func (doc *Document) SetPreview(shape func(image.Point) Drawable, out chan chan ColorPoint) {
+    doc.ClearPreview()
+    doc.preview = shape
+    doc.previewOut = out
+    // Moves from before the preview don't matter
+    for flushed := false; !flushed; {
+        select {
+        case <-doc.motion:
+        default:
+            flushed = true
+        }
+    }
+}
+
+func (doc *Document) ShowPreview(p image.Point) {
+    if doc.preview == nil { return }
+    doc.HidePreview()
+    drawable := doc.preview(p)
+    if drawable == nil { return }
+    doc.previewOut <- doc.DrawChan(drawable)
+    doc.previewShown = Damage(drawable)
+}
+
+func (doc *Document) HidePreview() {
+    if doc.previewShown.Dx() > 0 {
+        doc.Refresh(doc.previewShown, doc.previewOut)
+        doc.previewShown = image.Rectangle{}
+    }
+}
+
+func (doc *Document) ClearPreview() {
+    doc.HidePreview()
+    doc.preview = nil
+}
+
+// Outline of the rectangle with corners a and b
+func RectPoligon(a image.Point, b image.Point, props FigProps) Drawable {
+    points := new(list.List)
+    points.PushBack(a)
+    points.PushBack(image.Point{b.X, a.Y})
+    points.PushBack(b)
+    points.PushBack(image.Point{a.X, b.Y})
+    return &Poligon{points, props, Id{0}}
+}
+
+/* End previews */
+
+/* Helper functions for image.Rectangle */
+
+// Bounds of a list of points, with Max exclusive as in image.Rectangle
+func PointsBounds(points *list.List) image.Rectangle {
+    if points.Len() == 0 {
+        return image.Rectangle{}
+    }
+    first := points.Front().Value.(image.Point)
+    bounds := image.Rectangle{first, first.Add(image.Point{1, 1})}
+    for elem := points.Front(); elem != nil; elem = elem.Next() {
+        bounds = RectAddPoint(bounds, elem.Value.(image.Point))
+    }
+    return bounds
+}
+
+func RectAddPoint(rect image.Rectangle, point image.Point) image.Rectangle {
+    if point.X < rect.Min.X { rect.Min.X = point.X }
+    if point.Y < rect.Min.Y { rect.Min.Y = point.Y }
+    if point.X >= rect.Max.X { rect.Max.X = point.X + 1 }
+    if point.Y >= rect.Max.Y { rect.Max.Y = point.Y + 1 }
+    return rect
+}
+
+func RectUnion(r1 image.Rectangle, r2 image.Rectangle) image.Rectangle {
+    if r1.Dx() <= 0 || r1.Dy() <= 0 { return r2 }
+    if r2.Dx() <= 0 || r2.Dy() <= 0 { return r1 }
+    if r2.Min.X < r1.Min.X { r1.Min.X = r2.Min.X }
+    if r2.Min.Y < r1.Min.Y { r1.Min.Y = r2.Min.Y }
+    if r2.Max.X > r1.Max.X { r1.Max.X = r2.Max.X }
+    if r2.Max.Y > r1.Max.Y { r1.Max.Y = r2.Max.Y }
+    return r1
+}
+
+func RectIntersect(r1 image.Rectangle, r2 image.Rectangle) image.Rectangle {
+    if r2.Min.X > r1.Min.X { r1.Min.X = r2.Min.X }
+    if r2.Min.Y > r1.Min.Y { r1.Min.Y = r2.Min.Y }
+    if r2.Max.X < r1.Max.X { r1.Max.X = r2.Max.X }
+    if r2.Max.Y < r1.Max.Y { r1.Max.Y = r2.Max.Y }
+    if r1.Dx() <= 0 || r1.Dy() <= 0 {
+        return image.Rectangle{}
+    }
+    return r1
+}
+
+func RectExpand(rect image.Rectangle, n int) image.Rectangle {
+    return image.Rect(rect.Min.X - n, rect.Min.Y - n, rect.Max.X + n, rect.Max.Y + n)
+}
+
+func PointInRect(point image.Point, rect image.Rectangle) bool {
+    return point.X >= rect.Min.X && point.Y >= rect.Min.Y &&
+           point.X < rect.Max.X && point.Y < rect.Max.Y
+}
+
+func RectCenter(rect image.Rectangle) image.Point {
+    return MidPoint(rect.Min, rect.Max)
+}
+
+/* End helper functions for image.Rectangle */
+
+/* Segments */
+
+type Segment struct {
+    start image.Point
+    end image.Point
+}
+
+func (segment Segment) DistanceTo(point image.Point) float64 {
+    x, y := ClosestPointOnSegment(point, segment.start, segment.end)
+    return math.Hypot(float64(point.X) - x, float64(point.Y) - y)
+}
+
+// Intersection point of two segments, if they cross
+func SegmentIntersection(s1 Segment, s2 Segment) (image.Point, bool) {
+    x1, y1 := float64(s1.start.X), float64(s1.start.Y)
+    dx1, dy1 := float64(s1.end.X - s1.start.X), float64(s1.end.Y - s1.start.Y)
+    x2, y2 := float64(s2.start.X), float64(s2.start.Y)
+    dx2, dy2 := float64(s2.end.X - s2.start.X), float64(s2.end.Y - s2.start.Y)
+    det := dx1*dy2 - dy1*dx2
+    if det == 0 {
+        // Parallel or degenerate
+        return image.Point{}, false
+    }
+    t := ((x2 - x1)*dy2 - (y2 - y1)*dx2) / det
+    u := ((x2 - x1)*dy1 - (y2 - y1)*dx1) / det
+    if t < 0 || t > 1 || u < 0 || u > 1 {
+        return image.Point{}, false
+    }
+    return image.Point{Round(x1 + t*dx1), Round(y1 + t*dy1)}, true
+}
+
+// Segments of a closed path
+func PathSegments(points *list.List) *list.List {
+    segments := new(list.List)
+    if points.Len() < 2 {
+        return segments
+    }
+    before := points.Back().Value.(image.Point)
+    for elem := points.Front(); elem != nil; elem = elem.Next() {
+        after := elem.Value.(image.Point)
+        segments.PushBack(Segment{before, after})
+        before = after
+    }
+    return segments
+}
+
+// Chords of the arc from start around center, a few pixels long
+func ArcOutline(center image.Point, start image.Point, sweep float64) *list.List {
+    segments := new(list.List)
+    radius := PointsDistance(start, center)
+    n := int(math.Ceil(radius * math.Fabs(sweep) / 4))
+    if n < 8 { n = 8 }
+    start_ang := Theta(start.Sub(center))
+    before := start
+    for i := 1; i <= n; i++ {
+        ang := start_ang + sweep * float64(i) / float64(n)
+        after := center.Add(image.Point{Round(radius*math.Cos(ang)), Round(radius*math.Sin(ang))})
+        segments.PushBack(Segment{before, after})
+        before = after
+    }
+    return segments
+}
+
+// Whether the closed path has all of the stroke of drawable inside
+func PathEncloses(path *list.List, drawable Drawable) bool {
+    outline := drawable.Outline()
+    if path.Len() < 3 || outline.Len() == 0 {
+        return false
+    }
+    edges := PathSegments(path)
+    for elem := outline.Front(); elem != nil; elem = elem.Next() {
+        segment := elem.Value.(Segment)
+        if !PathContains(path, segment.start) || !PathContains(path, segment.end) {
+            return false
+        }
+        for edge := edges.Front(); edge != nil; edge = edge.Next() {
+            if _, ok := SegmentIntersection(segment, edge.Value.(Segment)); ok {
+                return false
+            }
+        }
+    }
+    return true
+}
+
+// Whether the open polyline crosses the stroke of drawable
+func PolylineCrosses(points *list.List, drawable Drawable) bool {
+    outline := drawable.Outline()
+    for p := points.Front(); p != nil && p.Next() != nil; p = p.Next() {
+        fence := Segment{p.Value.(image.Point), p.Next().Value.(image.Point)}
+        for elem := outline.Front(); elem != nil; elem = elem.Next() {
+            if _, ok := SegmentIntersection(fence, elem.Value.(Segment)); ok {
+                return true
+            }
+        }
+    }
+    return false
+}
+
+// The lines drawable is drawn with, with their styles
+func StrokeLines(drawable Drawable) *list.List {
+    lines := new(list.List)
+    var segments *list.List
+    var props FigProps
+    switch d := drawable.(type) {
+    case *Line:
+        lines.PushBack(*d)
+        return lines
+    case *Poligon:
+        segments, props = PathSegments(d.points), d.FigProps
+    case *RegularPoligon:
+        segments, props = PathSegments(d.Vertices()), d.FigProps
+    case *Circle:
+        // As in Circle.PointChan
+        sides := int(SIDE_RATIO * PointsDistance(d.start, d.center))
+        regpol := RegularPoligon{d.center, d.start, sides, d.FigProps, Id{0}}
+        segments, props = PathSegments(regpol.Vertices()), d.FigProps
+    case *CircleArc:
+        segments, props = d.Chords(), d.FigProps
+    case *Grouping:
+        for elem := d.draws.Front(); elem != nil; elem = elem.Next() {
+            lines.PushBackList(StrokeLines(elem.Value.(Drawable)))
+        }
+        return lines
+    default:
+        return lines
+    }
+    for elem := segments.Front(); elem != nil; elem = elem.Next() {
+        segment := elem.Value.(Segment)
+        lines.PushBack(Line{segment.start, segment.end, props, Id{0}})
+    }
+    return lines
+}
+
+const (
+    CLIP_LEFT = 1
+    CLIP_RIGHT = 2
+    CLIP_TOP = 4
+    CLIP_BOTTOM = 8
+)
+
+func ClipCode(x float64, y float64, rect image.Rectangle) int {
+    code := 0
+    if x < float64(rect.Min.X) { code |= CLIP_LEFT }
+    if x > float64(rect.Max.X - 1) { code |= CLIP_RIGHT }
+    if y < float64(rect.Min.Y) { code |= CLIP_TOP }
+    if y > float64(rect.Max.Y - 1) { code |= CLIP_BOTTOM }
+    return code
+}
+
+// Cohen-Sutherland clipping of the segment from a to b to rect
+func ClipLine(a image.Point, b image.Point, rect image.Rectangle) (image.Point, image.Point, bool) {
+    x0, y0 := float64(a.X), float64(a.Y)
+    x1, y1 := float64(b.X), float64(b.Y)
+    xmin, ymin := float64(rect.Min.X), float64(rect.Min.Y)
+    xmax, ymax := float64(rect.Max.X - 1), float64(rect.Max.Y - 1)
+    code0 := ClipCode(x0, y0, rect)
+    code1 := ClipCode(x1, y1, rect)
+    for {
+        if code0 | code1 == 0 {
+            return image.Point{Round(x0), Round(y0)}, image.Point{Round(x1), Round(y1)}, true
+        }
+        if code0 & code1 != 0 {
+            return a, b, false
+        }
+        code := code0
+        if code == 0 { code = code1 }
+        var x, y float64
+        switch {
+        case code & CLIP_TOP != 0:
+            x, y = x0 + (x1 - x0) * (ymin - y0) / (y1 - y0), ymin
+        case code & CLIP_BOTTOM != 0:
+            x, y = x0 + (x1 - x0) * (ymax - y0) / (y1 - y0), ymax
+        case code & CLIP_LEFT != 0:
+            x, y = xmin, y0 + (y1 - y0) * (xmin - x0) / (x1 - x0)
+        default:
+            x, y = xmax, y0 + (y1 - y0) * (xmax - x0) / (x1 - x0)
+        }
+        if code == code0 {
+            x0, y0 = x, y
+            code0 = ClipCode(x0, y0, rect)
+        } else {
+            x1, y1 = x, y
+            code1 = ClipCode(x1, y1, rect)
+        }
+    }
+    return a, b, false
+}
+
+/* End segments */
+
+/* Geometry of point lists */
+
+// Closest point to p on a closed path
+func PathClosestPoint(points *list.List, p image.Point) image.Point {
+    if points.Len() == 1 {
+        return points.Front().Value.(image.Point)
+    }
+    best := p
+    best_dist := math.Inf(1)
+    segments := PathSegments(points)
+    for elem := segments.Front(); elem != nil; elem = elem.Next() {
+        segment := elem.Value.(Segment)
+        x, y := ClosestPointOnSegment(p, segment.start, segment.end)
+        dist := math.Hypot(float64(p.X) - x, float64(p.Y) - y)
+        if dist < best_dist {
+            best, best_dist = image.Point{Round(x), Round(y)}, dist
+        }
+    }
+    return best
+}
+
+func PathLength(points *list.List) float64 {
+    length := 0.0
+    segments := PathSegments(points)
+    for elem := segments.Front(); elem != nil; elem = elem.Next() {
+        segment := elem.Value.(Segment)
+        length += PointsDistance(segment.start, segment.end)
+    }
+    return length
+}
+
+// Signed area by the shoelace formula
+func PathSignedArea(points *list.List) float64 {
+    area := 0.0
+    segments := PathSegments(points)
+    for elem := segments.Front(); elem != nil; elem = elem.Next() {
+        segment := elem.Value.(Segment)
+        area += float64(segment.start.X*segment.end.Y - segment.end.X*segment.start.Y)
+    }
+    return area / 2
+}
+
+// Centroid of the enclosed area, or the mean of the points if there
+// is no area
+func PathCentroid(points *list.List) image.Point {
+    if points.Len() == 0 {
+        return image.Point{}
+    }
+    area := PathSignedArea(points)
+    cx, cy := 0.0, 0.0
+    if area == 0 {
+        for elem := points.Front(); elem != nil; elem = elem.Next() {
+            point := elem.Value.(image.Point)
+            cx += float64(point.X)
+            cy += float64(point.Y)
+        }
+        n := float64(points.Len())
+        return image.Point{Round(cx / n), Round(cy / n)}
+    }
+    segments := PathSegments(points)
+    for elem := segments.Front(); elem != nil; elem = elem.Next() {
+        a, b := elem.Value.(Segment).start, elem.Value.(Segment).end
+        cross := float64(a.X*b.Y - b.X*a.Y)
+        cx += float64(a.X + b.X) * cross
+        cy += float64(a.Y + b.Y) * cross
+    }
+    return image.Point{Round(cx / (6*area)), Round(cy / (6*area))}
+}
+
+// Point at the given distance from center, towards p
+func CircleClosestPoint(center image.Point, radius float64, p image.Point, fallback image.Point) image.Point {
+    dist := PointsDistance(center, p)
+    if dist == 0 {
+        return fallback
+    }
+    delta := p.Sub(center)
+    return center.Add(image.Point{Round(float64(delta.X)*radius/dist), Round(float64(delta.Y)*radius/dist)})
+}
+
+/* End geometry of point lists */
+
+/* Boolean operations */
+
+const (
+    BOOL_UNION = 0
+    BOOL_INTERSECTION = 1
+    BOOL_DIFFERENCE = 2
+    BOOL_XOR = 3
+)
+
+const (
+    CLASS_OUT = 0
+    CLASS_IN = 1
+    CLASS_ON = 2
+)
+
+// Distance under which points are the same and a point is on an edge
+const BOOL_EPS = 1e-6
+
+type FPoint struct {
+    x, y float64
+}
+
+func FPointOf(p image.Point) FPoint {
+    return FPoint{float64(p.X), float64(p.Y)}
+}
+
+func (p FPoint) Sub(q FPoint) FPoint {
+    return FPoint{p.x - q.x, p.y - q.y}
+}
+
+func (p FPoint) Near(q FPoint) bool {
+    return math.Hypot(p.x - q.x, p.y - q.y) < BOOL_EPS
+}
 
-var currentWindows = new(list.List)
+func Cross(p FPoint, q FPoint) float64 {
+    return p.x*q.y - p.y*q.x
+}
 
-/* Functions for the Matrix */
+func Dot(p FPoint, q FPoint) float64 {
+    return p.x*q.x + p.y*q.y
+}
 
-func PushMatrix (color_point ColorPoint) {
-    matrix[color_point.point.X][color_point.point.Y].PushFront(color_point)
+// Piece of an edge between crossings with the other shape
+type Fragment struct {
+    start FPoint
+    end FPoint
+    used bool
 }
 
-func TopMatrix (point image.Point) Drawable {
-    element := matrix[point.X][point.Y].Front()
-    if element != nil {
-        return *(element.Value.(ColorPoint).drawable)
+// Vertices of a closed shape. Rectangles are poligons, circles are
+// flattened
+func ClosedPath(drawable Drawable) (*list.List, bool) {
+    switch d := drawable.(type) {
+    case *Poligon:
+        return d.points, d.points.Len() >= 3
+    case *RegularPoligon:
+        return d.Vertices(), d.sides >= 3
+    case *Circle:
+        points := new(list.List)
+        outline := d.Outline()
+        for elem := outline.Front(); elem != nil; elem = elem.Next() {
+            points.PushBack(elem.Value.(Segment).start)
+        }
+        return points, !d.center.Eq(d.start)
     }
-    return nil
+    return nil, false
 }
 
-func TopMatrixColorPoint (point image.Point) ColorPoint {
-    element := matrix[point.X][point.Y].Front()
-    if element != nil {
-        return element.Value.(ColorPoint)
+// The path without repeated points, with positive signed area
+func BoolPolygon(points *list.List) []FPoint {
+    unique := new(list.List)
+    for elem := points.Front(); elem != nil; elem = elem.Next() {
+        p := elem.Value.(image.Point)
+        if unique.Len() == 0 || !unique.Back().Value.(image.Point).Eq(p) {
+            unique.PushBack(p)
+        }
+    }
+    if unique.Len() > 1 && unique.Front().Value.(image.Point).Eq(unique.Back().Value.(image.Point)) {
+        unique.Remove(unique.Back())
+    }
+    reverse := PathSignedArea(unique) < 0
+    poly := make([]FPoint, unique.Len())
+    i := 0
+    for elem := unique.Front(); elem != nil; elem = elem.Next() {
+        if reverse {
+            poly[len(poly) - 1 - i] = FPointOf(elem.Value.(image.Point))
+        } else {
+            poly[i] = FPointOf(elem.Value.(image.Point))
+        }
+        i++
     }
-    return ColorPoint{point, image.RGBAColor{0, 0, 0, 255}, nil}
+    return poly
 }
 
-func PopMatrix (point image.Point) Drawable {
-    element := matrix[point.X][point.Y].Front()
-    if element != nil {
-        matrix[point.X][point.Y].Remove(element)
-        return *(element.Value.(ColorPoint).drawable)
+// Parameters along a-b where c-d crosses or touches it, including the
+// ends of c-d lying on a-b when both are on the same line
+func CrossingParams(a FPoint, b FPoint, c FPoint, d FPoint, params *list.List) {
+    r := b.Sub(a)
+    s := d.Sub(c)
+    qp := c.Sub(a)
+    rr := Dot(r, r)
+    if rr == 0 { return }
+    denom := Cross(r, s)
+    if math.Fabs(denom) > BOOL_EPS * math.Sqrt(rr * Dot(s, s)) {
+        t := Cross(qp, s) / denom
+        u := Cross(qp, r) / denom
+        if u >= -BOOL_EPS && u <= 1 + BOOL_EPS {
+            params.PushBack(t)
+        }
+        return
     }
-    return nil
+    if math.Fabs(Cross(qp, r)) / math.Sqrt(rr) > BOOL_EPS {
+        // Parallel
+        return
+    }
+    params.PushBack(Dot(c.Sub(a), r) / rr)
+    params.PushBack(Dot(d.Sub(a), r) / rr)
 }
 
-func RemoveFromMatrix(point image.Point, drawable interface{}) {
-    list := &matrix[point.X][point.Y]
-    elem := SearchList(list, drawable)
-    if (elem != nil) {
-        list.Remove(elem)
+// Edges of poly split at every point where other crosses or touches them
+func SplitEdges(poly []FPoint, other []FPoint) *list.List {
+    fragments := new(list.List)
+    n := len(poly)
+    for i := 0; i < n; i++ {
+        a, b := poly[i], poly[(i + 1) % n]
+        params := new(list.List)
+        for j := 0; j < len(other); j++ {
+            CrossingParams(a, b, other[j], other[(j + 1) % len(other)], params)
+        }
+        ts := make([]float64, params.Len() + 2)
+        k := 1
+        ts[0] = 0
+        for elem := params.Front(); elem != nil; elem = elem.Next() {
+            t := elem.Value.(float64)
+            if t <= 0 || t >= 1 {
+                t = 0
+            }
+            // Insertion sort
+            j := k
+            for ; j > 0 && ts[j-1] > t; j-- {
+                ts[j] = ts[j-1]
+            }
+            ts[j] = t
+            k++
+        }
+        ts[k] = 1
+        before := a
+        for j := 1; j <= k; j++ {
+            after := FPoint{a.x + ts[j]*(b.x - a.x), a.y + ts[j]*(b.y - a.y)}
+            if j == k { after = b }
+            if !before.Near(after) {
+                fragments.PushBack(&Fragment{before, after, false})
+                before = after
+            }
+        }
     }
+    return fragments
 }
 
-func ListMatrix(point image.Point) *list.List {
-    return &matrix[point.X][point.Y]
+func PointSegmentDistance(p FPoint, a FPoint, b FPoint) float64 {
+    r := b.Sub(a)
+    rr := Dot(r, r)
+    t := 0.0
+    if rr > 0 {
+        t = Dot(p.Sub(a), r) / rr
+        if t < 0 { t = 0 }
+        if t > 1 { t = 1 }
+    }
+    return math.Hypot(p.x - a.x - t*r.x, p.y - a.y - t*r.y)
 }
 
-func SearchNearPoint (point image.Point) (Drawable, image.Point) {
-    for radius := 0; radius < SEARCH_RADIUS; radius++ {
-        for x := point.X - radius; x <= point.X + radius; x++ {
-            for y := point.Y - radius; y <= point.Y + radius; y++ {
-                drawable := TopMatrix(image.Point{x, y})
-                if drawable != nil {
-                    //fmt.Println("Objeto encontrado")
-                    return drawable, image.Point{x, y}
-                }
+// Where the fragment lies against poly. For fragments on its boundary,
+// also whether they run in the same direction as the edge of poly
+func ClassifyFragment(fragment *Fragment, poly []FPoint) (int, bool) {
+    mid := FPoint{(fragment.start.x + fragment.end.x)/2, (fragment.start.y + fragment.end.y)/2}
+    dir := fragment.end.Sub(fragment.start)
+    n := len(poly)
+    inside := false
+    for i := 0; i < n; i++ {
+        a, b := poly[i], poly[(i + 1) % n]
+        if PointSegmentDistance(mid, a, b) < BOOL_EPS {
+            return CLASS_ON, Dot(dir, b.Sub(a)) > 0
+        }
+        if (a.y > mid.y) != (b.y > mid.y) {
+            x := a.x + (mid.y - a.y) * (b.x - a.x) / (b.y - a.y)
+            if mid.x < x {
+                inside = !inside
             }
         }
     }
-    fmt.Println("Objeto nao encontrado")
-    return nil, point
+    if inside {
+        return CLASS_IN, false
+    }
+    return CLASS_OUT, false
 }
 
-/* End funcions for the Matrix */
-
-/* Helper functions for list.List */
-
-func SearchList(list *list.List, subject interface{}) *list.Element {
-    for elem := list.Front(); elem != nil; elem = elem.Next() {
-        if elem.Value.(ColorPoint).drawable.GetId() == subject.(Drawable).GetId() {
-            return elem
+// Fragments of the edges of both shapes that bound the result. Pieces of
+// one shape kept inside the other are reversed, as they bound holes
+func BoolFragments(a []FPoint, b []FPoint, op int) *list.List {
+    kept := new(list.List)
+    keep := func(fragment *Fragment, reversed bool) {
+        if reversed {
+            fragment.start, fragment.end = fragment.end, fragment.start
         }
+        kept.PushBack(fragment)
     }
-    fmt.Println("Not found")
-    return nil
-}
-
-/* End helper funcions for list.List */
-
-/* Helper functions for image.Point */
-
-func PointsDistance(p1 image.Point, p2 image.Point) float64 {
-    return math.Sqrt(math.Pow(float64(p1.X - p2.X), 2) + math.Pow(float64(p1.Y - p2.Y), 2))
+    fragments := SplitEdges(a, b)
+    for elem := fragments.Front(); elem != nil; elem = elem.Next() {
+        fragment := elem.Value.(*Fragment)
+        class, same := ClassifyFragment(fragment, b)
+        switch op {
+        case BOOL_UNION, BOOL_INTERSECTION:
+            // Shared edges are taken once, from a
+            want := CLASS_OUT
+            if op == BOOL_INTERSECTION { want = CLASS_IN }
+            if class == want || class == CLASS_ON && same {
+                keep(fragment, false)
+            }
+        case BOOL_DIFFERENCE:
+            if class == CLASS_OUT || class == CLASS_ON && !same {
+                keep(fragment, false)
+            }
+        case BOOL_XOR:
+            // Shared edges have both shapes on one side, or one on
+            // each side, so neither copy bounds the result
+            if class == CLASS_OUT {
+                keep(fragment, false)
+            } else if class == CLASS_IN {
+                keep(fragment, true)
+            }
+        }
+    }
+    fragments = SplitEdges(b, a)
+    for elem := fragments.Front(); elem != nil; elem = elem.Next() {
+        fragment := elem.Value.(*Fragment)
+        class, _ := ClassifyFragment(fragment, a)
+        switch op {
+        case BOOL_UNION:
+            if class == CLASS_OUT { keep(fragment, false) }
+        case BOOL_INTERSECTION:
+            if class == CLASS_IN { keep(fragment, false) }
+        case BOOL_DIFFERENCE:
+            if class == CLASS_IN { keep(fragment, true) }
+        case BOOL_XOR:
+            if class == CLASS_OUT {
+                keep(fragment, false)
+            } else if class == CLASS_IN {
+                keep(fragment, true)
+            }
+        }
+    }
+    return kept
 }
 
-func Angle (origin image.Point, point1 image.Point, point2 image.Point) float64 {
-    // radius1 := point1.Sub(origin)
-    // ang1    := math.Atan(float64(int(radius1.Y))/float64(int(radius1.X)))
-    // if radius1.X < 0 { ang1 -= math.Pi }
-    // radius2 := point2.Sub(origin)
-    // ang2    := math.Atan(float64(int(radius2.Y))/float64(int(radius2.X)))
-    // if radius2.X < 0 { ang2 -= math.Pi }
-    return Theta(point2.Sub(origin))-Theta(point1.Sub(origin))
+// Joins the fragments end to start into closed paths. Where several
+// fragments leave the same point, as on touching vertices, the one
+// turning the least to the right is taken
+func LinkFragments(fragments *list.List) *list.List {
+    paths := new(list.List)
+    for first := fragments.Front(); first != nil; first = first.Next() {
+        start := first.Value.(*Fragment)
+        if start.used { continue }
+        start.used = true
+        path := new(list.List)
+        path.PushBack(start.start)
+        current := start
+        closed := false
+        for steps := 0; steps < fragments.Len(); steps++ {
+            if current.end.Near(start.start) {
+                closed = true
+                break
+            }
+            var next *Fragment
+            best := 0.0
+            dir := current.end.Sub(current.start)
+            for elem := fragments.Front(); elem != nil; elem = elem.Next() {
+                candidate := elem.Value.(*Fragment)
+                if candidate.used || !candidate.start.Near(current.end) { continue }
+                out := candidate.end.Sub(candidate.start)
+                turn := math.Atan2(Cross(dir, out), Dot(dir, out))
+                if next == nil || turn > best {
+                    next, best = candidate, turn
+                }
+            }
+            if next == nil { break }
+            next.used = true
+            path.PushBack(next.start)
+            current = next
+        }
+        if closed {
+            paths.PushBack(path)
+        }
+    }
+    return paths
 }
 
-func Theta(vector image.Point) float64{
-    // ang := math.Atan(float64(int(vector.Y))/float64(int(vector.X)))
-    // if vector.X < 0 { ang -= math.Pi }
-    return math.Atan2(float64(int(vector.Y)), float64(int(vector.X)))
+// Result of op on the closed paths a and b, as paths of points. Paths
+// with negative signed area are holes
+func BooleanPaths(a *list.List, b *list.List, op int) *list.List {
+    paths := LinkFragments(BoolFragments(BoolPolygon(a), BoolPolygon(b), op))
+    result := new(list.List)
+    for elem := paths.Front(); elem != nil; elem = elem.Next() {
+        points := new(list.List)
+        for p := elem.Value.(*list.List).Front(); p != nil; p = p.Next() {
+            fp := p.Value.(FPoint)
+            point := image.Point{Round(fp.x), Round(fp.y)}
+            if points.Len() == 0 || !points.Back().Value.(image.Point).Eq(point) {
+                points.PushBack(point)
+            }
+        }
+        if points.Len() > 1 && points.Front().Value.(image.Point).Eq(points.Back().Value.(image.Point)) {
+            points.Remove(points.Back())
+        }
+        if points.Len() >= 3 && math.Fabs(PathSignedArea(points)) >= 1 {
+            result.PushBack(points)
+        }
+    }
+    return result
 }
 
-func RotatePoint(point image.Point, origin image.Point, angle float64) image.Point {
-    delta := point.Sub(origin)
-    x := float64(int(delta.X))*math.Cos(angle) - float64(int(delta.Y))*math.Sin(angle)
-    y := float64(int(delta.X))*math.Sin(angle) + float64(int(delta.Y))*math.Cos(angle)
-    return image.Point{int(float64(x)), int(float64(y))}.Add(origin)
+// Poligon for a single path, or a grouping of the outlines and holes
+func BooleanResult(paths *list.List, props FigProps) Drawable {
+    if paths.Len() == 1 {
+        return &Poligon{paths.Front().Value.(*list.List), props, Id{0}}
+    }
+    draws := new(list.List)
+    for elem := paths.Front(); elem != nil; elem = elem.Next() {
+        draws.PushBack(&Poligon{elem.Value.(*list.List), props, Id{0}})
+    }
+    return &Grouping{draws, Id{0}}
 }
 
-/* End helper functions for image.Point */
+/* End boolean operations */
 
 
 func abs(n int) int {
@@ -155,7 +2739,8 @@ type Window struct {
     first   image.Point
     last    image.Point
     target  image.Point
-    zoom    int
+    zoom    float64
+    selected bool
 }
 
 func (window Window) PointIn(point image.Point) bool {
@@ -181,7 +2766,7 @@ func (window Window) Size() (int, int) {
 
 func (window Window) TargetSize() (int, int) {
     x, y := window.Size()
-    return x*window.zoom, y*window.zoom
+    return ZoomCoord(x, window.zoom), ZoomCoord(y, window.zoom)
 }
 
 func (window Window) PointInTarget(point image.Point) bool {
@@ -193,18 +2778,77 @@ func (window Window) PointInTarget(point image.Point) bool {
     return true
 }
 
+// First pixel of the target whose center falls in the source pixel n
+// pixels from the start. Below 1, several source pixels share a target
+// pixel
+func ZoomCoord(n int, zoom float64) int {
+    return int(math.Ceil(float64(n) * zoom - 0.5))
+}
+
+// Source pixel under the center of the target pixel n, the inverse of
+// ZoomCoord
+func UnzoomCoord(n int, zoom float64) int {
+    return int(math.Floor((float64(n) + 0.5) / zoom))
+}
+
 func (window Window) TransferPoint (point image.Point) image.Point {
-    zoom := window.zoom
     relpoint := point.Sub(window.first)
-    zoompoint := image.Point{relpoint.X * zoom, relpoint.Y * zoom}
+    zoompoint := image.Point{ZoomCoord(relpoint.X, window.zoom), ZoomCoord(relpoint.Y, window.zoom)}
     return zoompoint.Add(window.target)
 }
 
 func (window Window) TransferPointBack (point image.Point) image.Point {
-    zoom := window.zoom
+    if window.zoom <= 0 { return point }
     relpoint := point.Sub(window.target)
-    zoompoint := image.Point{relpoint.X / zoom, relpoint.Y / zoom}
-    return zoompoint.Add(window.first)
+    zoompoint := image.Point{UnzoomCoord(relpoint.X, window.zoom), UnzoomCoord(relpoint.Y, window.zoom)}
+    point = zoompoint.Add(window.first)
+    // Rounding may pass the last pixel when shrinking
+    if point.X > window.last.X { point.X = window.last.X }
+    if point.Y > window.last.Y { point.Y = window.last.Y }
+    return point
+}
+
+// Inside of the target, without the border
+func (window Window) TargetInterior() image.Rectangle {
+    sx, sy := window.TargetSize()
+    return image.Rect(window.target.X + 1, window.target.Y + 1, window.target.X + sx, window.target.Y + sy)
+}
+
+// Copy of drawable in the coordinates of the target. Each source pixel
+// becomes a zoom x zoom block, shapes go through the middle of it
+func (window Window) Magnify(drawable Drawable) Drawable {
+    magnified := drawable.Clone()
+    magnified.Move(image.Point{-window.first.X, -window.first.Y})
+    magnified.Scale(image.Point{0, 0}, window.zoom, window.zoom)
+    half := Round((window.zoom - 1) / 2)
+    magnified.Move(window.target.Add(image.Point{half, half}))
+    return magnified
+}
+
+// The magnified drawable clipped to the target and drawn again at that
+// scale, so lines stay one pixel wide
+func (window Window) MagnifiedChan(drawable Drawable) chan ColorPoint {
+    out := make(chan ColorPoint, BUF_SIZE)
+    lines := StrokeLines(window.Magnify(drawable))
+    interior := window.TargetInterior()
+    go func() {
+        for elem := lines.Front(); elem != nil; elem = elem.Next() {
+            line := elem.Value.(Line)
+            start, end, ok := ClipLine(line.start, line.end, interior)
+            if !ok { continue }
+            clipped := Line{start, end, line.FigProps, Id{0}}
+            in := clipped.PointChan()
+            for ! closed(in) {
+                cp := <-in
+                if closed(in) { break }
+                if PointInRect(cp.point, interior) {
+                    out <- cp
+                }
+            }
+        }
+        close(out)
+    }()
+    return out
 }
 
 func (window Window) PointChan() chan ColorPoint {
@@ -221,6 +2865,9 @@ func (window Window) PointChan() chan ColorPoint {
         p7 := window.target.Add(image.Point{sx, sy})
         p8 := window.target.Add(image.Point{0, sy})
         figprops := FigProps{image.RGBAColor{255, 255, 0, 255}, SOLID, false}
+        if window.selected {
+            figprops.color = selectionColor
+        }
         go func() {
             line := Line{p1, p2, figprops, Id{0}}
             pc := line.PointChan()
@@ -293,29 +2940,103 @@ func (window Window) PointChan() chan ColorPoint {
     return out
 }
 
-func (window Window) RedrawContent() chan ColorPoint {
-    out := make(chan ColorPoint, BUF_SIZE)
-    go func() {
-        for x := window.first.X + 1; x < window.last.X; x++ {
-            for y := window.first.Y + 1; y < window.last.Y; y++ {
-                cp := TopMatrixColorPoint (image.Point{x, y})
-                out <- cp
-    //            cp = window.TransferPoint(cp)
-    //            for sx := 0; sx < window.size; sx++ {
-    //                for sy := 0; sy < window.size; sy++ {
-    //                }
-    //            }
+// Distance from point to the nearest border, of the source or the target
+func (window Window) BorderDistance(point image.Point) float64 {
+    sx, sy := window.TargetSize()
+    borders := new(list.List)
+    borders.PushBackList(PathSegments(RectPoligon(window.first, window.last, FigProps{}).(*Poligon).points))
+    borders.PushBackList(PathSegments(RectPoligon(window.target, window.target.Add(image.Point{sx, sy}), FigProps{}).(*Poligon).points))
+    dist := math.Inf(1)
+    for elem := borders.Front(); elem != nil; elem = elem.Next() {
+        if d := elem.Value.(Segment).DistanceTo(point); d < dist {
+            dist = d
+        }
+    }
+    return dist
+}
+
+func (window Window) SourceRect() image.Rectangle {
+    return image.Rectangle{window.first, window.last.Add(image.Point{1, 1})}
+}
+
+func (window Window) TargetRect() image.Rectangle {
+    sx, sy := window.TargetSize()
+    return image.Rectangle{window.target, window.target.Add(image.Point{sx + 1, sy + 1})}
+}
+
+// Where rect of the source is shown in the target
+func (window Window) TransferRect(rect image.Rectangle) image.Rectangle {
+    return image.Rectangle{window.TransferPoint(rect.Min), window.TransferPoint(rect.Max)}
+}
+
+/* Grid */
+
+type Grid struct {
+    origin image.Point
+    spacing int
+    visible bool
+    snap bool
+}
+
+var backgroundColor = image.RGBAColor{0, 0, 0, 255}
+var gridColor = image.RGBAColor{64, 64, 64, 255}
+
+func (grid Grid) PointOn(point image.Point) bool {
+    rel := point.Sub(grid.origin)
+    return rel.X % grid.spacing == 0 || rel.Y % grid.spacing == 0
+}
+
+// Same as PointOn, for a point in the target of a window. The lines
+// keep one pixel wide, on the first pixel of the magnified source pixel
+func (grid Grid) PointOnWindow(window Window, point image.Point) bool {
+    if window.zoom <= 0 { return false }
+    source := window.TransferPointBack(point)
+    start := window.TransferPoint(source)
+    rel := source.Sub(grid.origin)
+    return (rel.X % grid.spacing == 0 && start.X == point.X) ||
+           (rel.Y % grid.spacing == 0 && start.Y == point.Y)
+}
+
+func (grid Grid) Snap(point image.Point) image.Point {
+    rel := point.Sub(grid.origin)
+    return image.Point{RoundTo(rel.X, grid.spacing), RoundTo(rel.Y, grid.spacing)}.Add(grid.origin)
+}
+
+// Rounds n to the nearest multiple of step
+func RoundTo(n int, step int) int {
+    return int(math.Floor(float64(n)/float64(step) + 0.5)) * step
+}
+
+// Color of the empty canvas, with the grid under all shapes. It keeps
+// the grid and windows as they are now
+func (doc *Document) Background() (func(image.Point) ColorPoint) {
+    grid := doc.grid
+    windows := new(list.List)
+    windows.PushBackList(doc.windows)
+    return func(point image.Point) ColorPoint {
+        if grid.visible {
+            for elem := windows.Back(); elem != nil; elem = elem.Prev() {
+                window := elem.Value.(Window)
+                if window.PointInTarget(point) {
+                    if grid.PointOnWindow(window, point) {
+                        return ColorPoint{point, gridColor}
+                    }
+                    return ColorPoint{point, backgroundColor}
+                }
+            }
+            if grid.PointOn(point) {
+                return ColorPoint{point, gridColor}
             }
         }
-        close(out)
-    }()
-    return out
+        return ColorPoint{point, backgroundColor}
+    }
 }
 
+/* End grid */
+
 type ColorPoint struct {
     point image.Point
     color image.RGBAColor
-    drawable *Drawable
 }
 
 func (colorpoint ColorPoint) Valid() bool {
@@ -326,10 +3047,10 @@ func (colorpoint ColorPoint) Valid() bool {
     if point.Y < 0 {
         return false
     }
-    if point.X >= WMAX {
+    if point.X >= screenRect.Max.X {
         return false
     }
-    if point.Y >= HMAX {
+    if point.Y >= screenRect.Max.Y {
         return false
     }
     return true
@@ -341,9 +3062,20 @@ type Drawable interface {
     SetId(int)
     Move(image.Point)
     RotatePoints(image.Point, float64)
+    Scale(image.Point, float64, float64) // About the point, by x and y
     Clone() Drawable
     MirrorX()
     MirrorY()
+    SnapTargets() *list.List
+    Segments() *list.List
+    Bounds() image.Rectangle
+    Perimeter() float64
+    Area() float64 // Zero for open shapes
+    Centroid() image.Point
+    ClosestPoint(image.Point) image.Point
+    Contains(image.Point) bool // False for open shapes
+    Restyle(func(*FigProps))
+    Outline() *list.List // Segments along the stroke, curves flattened
 }
 
 type Id struct {
@@ -364,8 +3096,8 @@ type FigProps struct {
     thick bool
 }
 
-func CurrentFigProps() FigProps {
-    return FigProps{currentColor, currentDashStyle, currentThick}
+func (props *FigProps) Restyle(change func(*FigProps)) {
+    change(props)
 }
 
 // Line
@@ -377,8 +3109,12 @@ type Line struct {
 }
 
 func (line *Line) Clone() Drawable {
-    counter_id++
-    return &Line{line.start, line.end, line.FigProps, Id{counter_id}}
+    return &Line{line.start, line.end, line.FigProps, Id{0}}
+}
+
+func (line *Line) Scale(origin image.Point, sx float64, sy float64) {
+    line.start = ScalePoint(line.start, origin, sx, sy)
+    line.end = ScalePoint(line.end, origin, sx, sy)
 }
 
 func (line *Line) MirrorX() {
@@ -438,14 +3174,14 @@ func (line *Line) PointChan() chan ColorPoint {
             if showpoint {
                 if steep {
                     if line.FigProps.thick {
-                        pointchan <- ColorPoint{image.Point{y+1, x}, line.FigProps.color, nil}
+                        pointchan <- ColorPoint{image.Point{y+1, x}, line.FigProps.color}
                     }
-                    pointchan <-ColorPoint{image.Point{y, x}, line.FigProps.color, nil}
+                    pointchan <-ColorPoint{image.Point{y, x}, line.FigProps.color}
                 } else {
                     if line.FigProps.thick {
-                        pointchan <-ColorPoint{image.Point{x, y+1}, line.FigProps.color, nil}
+                        pointchan <-ColorPoint{image.Point{x, y+1}, line.FigProps.color}
                     }
-                    pointchan <-ColorPoint{image.Point{x, y}, line.FigProps.color, nil}
+                    pointchan <-ColorPoint{image.Point{x, y}, line.FigProps.color}
                 }
             }
             error = error - deltay
@@ -464,6 +3200,52 @@ func (line *Line) Move (dest image.Point) {
     line.end   = line.end.Add(dest)
 }
 
+func (line *Line) SnapTargets() *list.List {
+    targets := new(list.List)
+    targets.PushBack(SnapTarget{line.start, SNAP_ENDPOINT})
+    targets.PushBack(SnapTarget{line.end, SNAP_ENDPOINT})
+    targets.PushBack(SnapTarget{MidPoint(line.start, line.end), SNAP_MIDPOINT})
+    return targets
+}
+
+func (line *Line) Bounds() image.Rectangle {
+    points := new(list.List)
+    points.PushBack(line.start)
+    points.PushBack(line.end)
+    return PointsBounds(points)
+}
+
+func (line *Line) Perimeter() float64 {
+    return PointsDistance(line.start, line.end)
+}
+
+func (line *Line) Area() float64 {
+    return 0
+}
+
+func (line *Line) Centroid() image.Point {
+    return MidPoint(line.start, line.end)
+}
+
+func (line *Line) ClosestPoint(p image.Point) image.Point {
+    x, y := ClosestPointOnSegment(p, line.start, line.end)
+    return image.Point{Round(x), Round(y)}
+}
+
+func (line *Line) Contains(p image.Point) bool {
+    return false
+}
+
+func (line *Line) Segments() *list.List {
+    segments := new(list.List)
+    segments.PushBack(Segment{line.start, line.end})
+    return segments
+}
+
+func (line *Line) Outline() *list.List {
+    return line.Segments()
+}
+
 // Poligon
 type Poligon struct {
     points *list.List
@@ -471,6 +3253,12 @@ type Poligon struct {
     Id
 }
 
+func (poligon *Poligon) Scale(origin image.Point, sx float64, sy float64) {
+    for elem := poligon.points.Front(); elem != nil; elem = elem.Next() {
+        elem.Value = ScalePoint(elem.Value.(image.Point), origin, sx, sy)
+    }
+}
+
 func (poligon *Poligon) MirrorX() {
     for elem := poligon.points.Front(); elem != nil; elem = elem.Next() {
         point := elem.Value.(image.Point)
@@ -491,10 +3279,9 @@ func (poligon *Poligon) Clone() Drawable {
     point_list := new(list.List)
     for elem := poligon.points.Front(); elem != nil; elem = elem.Next() {
         point := elem.Value.(image.Point)
-        point_list.PushFront(point)
+        point_list.PushBack(point)
     }
-    counter_id++
-    return &Poligon{point_list, poligon.FigProps, Id{counter_id}}
+    return &Poligon{point_list, poligon.FigProps, Id{0}}
 }
 
 func (poligon *Poligon) RotatePoints(origin image.Point, angle float64){
@@ -541,6 +3328,54 @@ func (poligon *Poligon) Move(delta image.Point) {
     }
 }
 
+func (poligon *Poligon) SnapTargets() *list.List {
+    targets := new(list.List)
+    for elem := poligon.points.Front(); elem != nil; elem = elem.Next() {
+        targets.PushBack(SnapTarget{elem.Value.(image.Point), SNAP_ENDPOINT})
+    }
+    segments := poligon.Segments()
+    for elem := segments.Front(); elem != nil; elem = elem.Next() {
+        segment := elem.Value.(Segment)
+        targets.PushBack(SnapTarget{MidPoint(segment.start, segment.end), SNAP_MIDPOINT})
+    }
+    return targets
+}
+
+func (poligon *Poligon) Segments() *list.List {
+    return PathSegments(poligon.points)
+}
+
+func (poligon *Poligon) Outline() *list.List {
+    return poligon.Segments()
+}
+
+func (poligon *Poligon) Bounds() image.Rectangle {
+    return PointsBounds(poligon.points)
+}
+
+func (poligon *Poligon) Contains(p image.Point) bool {
+    return PathContains(poligon.points, p)
+}
+
+func (poligon *Poligon) Perimeter() float64 {
+    return PathLength(poligon.points)
+}
+
+func (poligon *Poligon) Area() float64 {
+    return math.Fabs(PathSignedArea(poligon.points))
+}
+
+func (poligon *Poligon) Centroid() image.Point {
+    return PathCentroid(poligon.points)
+}
+
+func (poligon *Poligon) ClosestPoint(p image.Point) image.Point {
+    if poligon.points.Len() == 0 {
+        return p
+    }
+    return PathClosestPoint(poligon.points, p)
+}
+
 // Regular Poligon
 type RegularPoligon struct {
     origin  image.Point
@@ -550,6 +3385,10 @@ type RegularPoligon struct {
     Id
 }
 
+func (reg *RegularPoligon) Scale(origin image.Point, sx float64, sy float64) {
+    ScaleRound(&reg.origin, &reg.start, origin, sx, sy)
+}
+
 func (reg *RegularPoligon) MirrorX() {
     reg.start.X  = -reg.start.X
     reg.origin.X = -reg.origin.X
@@ -561,8 +3400,7 @@ func (reg *RegularPoligon) MirrorY() {
 }
 
 func (reg *RegularPoligon) Clone() Drawable {
-    counter_id++
-    return &RegularPoligon{reg.origin, reg.start, reg.sides, reg.FigProps, Id{counter_id}}
+    return &RegularPoligon{reg.origin, reg.start, reg.sides, reg.FigProps, Id{0}}
 }
 
 func (regpol *RegularPoligon) Move(delta image.Point) {
@@ -575,7 +3413,7 @@ func (reg *RegularPoligon) RotatePoints(origin image.Point, angle float64){
     reg.origin = RotatePoint(reg.origin, origin, angle)
 }
 
-func (regpol *RegularPoligon) PointChan() chan ColorPoint {
+func (regpol *RegularPoligon) Vertices() *list.List {
     start := regpol.start
     origin := regpol.origin
     sides := regpol.sides
@@ -591,27 +3429,76 @@ func (regpol *RegularPoligon) PointChan() chan ColorPoint {
         poli_points.PushBack(p)
 //        fmt.Println("Ponto: ", p)
     }
-    poligon := Poligon{poli_points, regpol.FigProps, Id{0}}
+    return poli_points
+}
+
+func (regpol *RegularPoligon) PointChan() chan ColorPoint {
+    poligon := Poligon{regpol.Vertices(), regpol.FigProps, Id{0}}
     return poligon.PointChan()
 }
 
+func (regpol *RegularPoligon) SnapTargets() *list.List {
+    poligon := Poligon{regpol.Vertices(), regpol.FigProps, Id{0}}
+    targets := poligon.SnapTargets()
+    targets.PushBack(SnapTarget{regpol.origin, SNAP_CENTER})
+    return targets
+}
+
+func (regpol *RegularPoligon) Segments() *list.List {
+    return PathSegments(regpol.Vertices())
+}
+
+func (regpol *RegularPoligon) Outline() *list.List {
+    return regpol.Segments()
+}
+
+func (regpol *RegularPoligon) Bounds() image.Rectangle {
+    return PointsBounds(regpol.Vertices())
+}
+
+func (regpol *RegularPoligon) Contains(p image.Point) bool {
+    return PathContains(regpol.Vertices(), p)
+}
+
+func (regpol *RegularPoligon) Perimeter() float64 {
+    radius := PointsDistance(regpol.start, regpol.origin)
+    sides := float64(regpol.sides)
+    return sides * 2 * radius * math.Sin(math.Pi / sides)
+}
+
+func (regpol *RegularPoligon) Area() float64 {
+    radius := PointsDistance(regpol.start, regpol.origin)
+    sides := float64(regpol.sides)
+    return sides * radius * radius * math.Sin(2 * math.Pi / sides) / 2
+}
+
+func (regpol *RegularPoligon) Centroid() image.Point {
+    return regpol.origin
+}
+
+func (regpol *RegularPoligon) ClosestPoint(p image.Point) image.Point {
+    return PathClosestPoint(regpol.Vertices(), p)
+}
+
 // Grouping
 type Grouping struct {
     draws *list.List
     Id
 }
 
-func (group *Grouping) Degrouping(out chan chan ColorPoint) {
+func (group *Grouping) Degrouping(doc *Document, out chan chan ColorPoint) {
+    doc.Begin()
     for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
         drawable := elem.Value.(Drawable).Clone()
-        out <- RegisterPoints(CurrentFilters()(drawable.PointChan()), drawable)
+        doc.Add(drawable, out)
     }
-    Delete(group, out)
+    doc.Delete(group, out)
+    doc.Commit()
 }
 
-func (group *Grouping) DeleteOriginals(out chan chan ColorPoint) {
+func (group *Grouping) DeleteOriginals(doc *Document, out chan chan ColorPoint) {
     for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
-        Delete(elem.Value.(Drawable), out)
+        doc.Delete(elem.Value.(Drawable), out)
     }
 }
 
@@ -620,8 +3507,7 @@ func (group *Grouping) Clone() Drawable {
     for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
         draws_list.PushBack(elem.Value.(Drawable).Clone())
     }
-    counter_id++
-    return &Grouping{draws_list, Id{counter_id}}
+    return &Grouping{draws_list, Id{0}}
 }
 
 func (group *Grouping) PointChan() chan ColorPoint {
@@ -650,6 +3536,18 @@ func (group *Grouping) Move(delta image.Point) {
     }
 }
 
+func (group *Grouping) Restyle(change func(*FigProps)) {
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        elem.Value.(Drawable).Restyle(change)
+    }
+}
+
+func (group *Grouping) Scale(origin image.Point, sx float64, sy float64) {
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        elem.Value.(Drawable).Scale(origin, sx, sy)
+    }
+}
+
 func (group *Grouping) MirrorX() {
     for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
         elem.Value.(Drawable).MirrorX()
@@ -662,6 +3560,97 @@ func (group *Grouping) MirrorY() {
     }
 }
 
+func (group *Grouping) SnapTargets() *list.List {
+    targets := new(list.List)
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        targets.PushBackList(elem.Value.(Drawable).SnapTargets())
+    }
+    return targets
+}
+
+func (group *Grouping) Segments() *list.List {
+    segments := new(list.List)
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        segments.PushBackList(elem.Value.(Drawable).Segments())
+    }
+    return segments
+}
+
+func (group *Grouping) Outline() *list.List {
+    segments := new(list.List)
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        segments.PushBackList(elem.Value.(Drawable).Outline())
+    }
+    return segments
+}
+
+func (group *Grouping) Bounds() image.Rectangle {
+    var bounds image.Rectangle
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        bounds = RectUnion(bounds, elem.Value.(Drawable).Bounds())
+    }
+    return bounds
+}
+
+func (group *Grouping) Contains(p image.Point) bool {
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        if elem.Value.(Drawable).Contains(p) {
+            return true
+        }
+    }
+    return false
+}
+
+func (group *Grouping) Perimeter() float64 {
+    perimeter := 0.0
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        perimeter += elem.Value.(Drawable).Perimeter()
+    }
+    return perimeter
+}
+
+func (group *Grouping) Area() float64 {
+    area := 0.0
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        area += elem.Value.(Drawable).Area()
+    }
+    return area
+}
+
+// Weighted by area, or by length if nothing is closed
+func (group *Grouping) Centroid() image.Point {
+    total, cx, cy := 0.0, 0.0, 0.0
+    by_area := group.Area() > 0
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        weight := drawable.Perimeter()
+        if by_area {
+            weight = drawable.Area()
+        }
+        centroid := drawable.Centroid()
+        cx += float64(centroid.X) * weight
+        cy += float64(centroid.Y) * weight
+        total += weight
+    }
+    if total == 0 {
+        return RectCenter(group.Bounds())
+    }
+    return image.Point{Round(cx / total), Round(cy / total)}
+}
+
+func (group *Grouping) ClosestPoint(p image.Point) image.Point {
+    best := p
+    best_dist := math.Inf(1)
+    for elem := group.draws.Front(); elem != nil; elem = elem.Next() {
+        point := elem.Value.(Drawable).ClosestPoint(p)
+        dist := PointsDistance(point, p)
+        if dist < best_dist {
+            best, best_dist = point, dist
+        }
+    }
+    return best
+}
+
 // Circle
 type Circle struct {
     center  image.Point
@@ -670,6 +3659,10 @@ type Circle struct {
     Id
 }
 
+func (circle  *Circle) Scale(origin image.Point, sx float64, sy float64) {
+    ScaleRound(&circle.center, &circle.start, origin, sx, sy)
+}
+
 func (circle  *Circle) MirrorX() {
     circle.start.X  = -circle.start.X
     circle.center.X = -circle.center.X
@@ -681,8 +3674,7 @@ func (circle  *Circle) MirrorY() {
 }
 
 func (circle *Circle) Clone() Drawable {
-    counter_id++
-    return &Circle{circle.center, circle.start, circle.FigProps, Id{counter_id}}
+    return &Circle{circle.center, circle.start, circle.FigProps, Id{0}}
 }
 
 func (circle *Circle) PointChan() chan ColorPoint {
@@ -703,6 +3695,47 @@ func (circle *Circle) RotatePoints(origin image.Point, angle float64){
     circle.start  = RotatePoint(circle.start, origin, angle)
 }
 
+func (circle *Circle) SnapTargets() *list.List {
+    targets := new(list.List)
+    targets.PushBack(SnapTarget{circle.center, SNAP_CENTER})
+    return targets
+}
+
+func (circle *Circle) Segments() *list.List {
+    return new(list.List)
+}
+
+func (circle *Circle) Outline() *list.List {
+    return ArcOutline(circle.center, circle.start, 2*math.Pi)
+}
+
+func (circle *Circle) Contains(p image.Point) bool {
+    return PointsDistance(p, circle.center) < PointsDistance(circle.start, circle.center)
+}
+
+func (circle *Circle) Perimeter() float64 {
+    return 2 * math.Pi * PointsDistance(circle.start, circle.center)
+}
+
+func (circle *Circle) Area() float64 {
+    radius := PointsDistance(circle.start, circle.center)
+    return math.Pi * radius * radius
+}
+
+func (circle *Circle) Centroid() image.Point {
+    return circle.center
+}
+
+func (circle *Circle) ClosestPoint(p image.Point) image.Point {
+    return CircleClosestPoint(circle.center, PointsDistance(circle.start, circle.center), p, circle.start)
+}
+
+func (circle *Circle) Bounds() image.Rectangle {
+    radius := int(math.Ceil(PointsDistance(circle.start, circle.center)))
+    delta := image.Point{radius, radius}
+    return image.Rectangle{circle.center.Sub(delta), circle.center.Add(delta).Add(image.Point{1, 1})}
+}
+
 // CircleArc
 type CircleArc struct {
     center  image.Point
@@ -715,32 +3748,43 @@ type CircleArc struct {
 func (ca *CircleArc) PointChan() chan ColorPoint {
     out := make(chan ColorPoint, BUF_SIZE)
     go func() {
-        start := ca.start
-        origin := ca.center
-        radiuslen := PointsDistance(start, origin)
-        radius := start.Sub(origin)
-        sides := int(SIDE_RATIO * radiuslen)
-        maxsides := int(SIDE_RATIO * radiuslen * ca.angle / (2*math.Pi)) + 1
-        start_ang := math.Atan(float64(int(radius.Y))/float64(int(radius.X)))
-        if radius.X < 0 { start_ang -= math.Pi }
-        module := math.Sqrt(math.Pow(float64(int(radius.X)), 2)+math.Pow(float64(int(radius.Y)), 2))
-        theta := 2*math.Pi/float64(int(sides))
-        var before, after image.Point
-        before = start
-        for i := 0; i < maxsides; i++ {
-            after = origin.Add(image.Point{int(float64(module*math.Cos(float64(int(i))*theta+start_ang))), int(float64(module*math.Sin(float64(int(i))*theta+start_ang)))})
-            line := Line{before, after, ca.FigProps, Id{0}}
+        chords := ca.Chords()
+        for elem := chords.Front(); elem != nil; elem = elem.Next() {
+            segment := elem.Value.(Segment)
+            line := Line{segment.start, segment.end, ca.FigProps, Id{0}}
             in := line.PointChan()
             for ! closed(in) {
                 out <- <-in
             }
-            before = after
         }
         close(out)
     }()
     return out
 }
 
+// The segments the arc is drawn with
+func (ca *CircleArc) Chords() *list.List {
+    chords := new(list.List)
+    start := ca.start
+    origin := ca.center
+    radiuslen := PointsDistance(start, origin)
+    radius := start.Sub(origin)
+    sides := int(SIDE_RATIO * radiuslen)
+    maxsides := int(SIDE_RATIO * radiuslen * ca.angle / (2*math.Pi)) + 1
+    start_ang := math.Atan(float64(int(radius.Y))/float64(int(radius.X)))
+    if radius.X < 0 { start_ang -= math.Pi }
+    module := math.Sqrt(math.Pow(float64(int(radius.X)), 2)+math.Pow(float64(int(radius.Y)), 2))
+    theta := 2*math.Pi/float64(int(sides))
+    var before, after image.Point
+    before = start
+    for i := 0; i < maxsides; i++ {
+        after = origin.Add(image.Point{int(float64(module*math.Cos(float64(int(i))*theta+start_ang))), int(float64(module*math.Sin(float64(int(i))*theta+start_ang)))})
+        chords.PushBack(Segment{before, after})
+        before = after
+    }
+    return chords
+}
+
 func (circle *CircleArc) Move(delta image.Point) {
     circle.center   = circle.center.Add(delta)
     circle.start    = circle.start.Add(delta)
@@ -751,6 +3795,10 @@ func (circle *CircleArc) RotatePoints(origin image.Point, angle float64){
     circle.start  = RotatePoint(circle.start, origin, angle)
 }
 
+func (circle  *CircleArc) Scale(origin image.Point, sx float64, sy float64) {
+    ScaleRound(&circle.center, &circle.start, origin, sx, sy)
+}
+
 func (circle  *CircleArc) MirrorX() {
     circle.start.X  = -circle.start.X
     circle.center.X = -circle.center.X
@@ -766,38 +3814,148 @@ func (circle  *CircleArc) MirrorY() {
 }
 
 func (circle *CircleArc) Clone() Drawable {
-    counter_id++
-    return &CircleArc{circle.center, circle.start, circle.angle, circle.FigProps, Id{counter_id}}
+    return &CircleArc{circle.center, circle.start, circle.angle, circle.FigProps, Id{0}}
 }
 
-func MouseHandler(mousechan <-chan draw.Mouse) chan image.Point {
-    out := make(chan image.Point)
+func (circle *CircleArc) SnapTargets() *list.List {
+    targets := new(list.List)
+    targets.PushBack(SnapTarget{circle.center, SNAP_CENTER})
+    targets.PushBack(SnapTarget{circle.start, SNAP_ENDPOINT})
+    targets.PushBack(SnapTarget{RotatePoint(circle.start, circle.center, circle.angle), SNAP_ENDPOINT})
+    targets.PushBack(SnapTarget{RotatePoint(circle.start, circle.center, circle.angle/2), SNAP_MIDPOINT})
+    return targets
+}
+
+func (circle *CircleArc) Segments() *list.List {
+    return new(list.List)
+}
+
+func (circle *CircleArc) Outline() *list.List {
+    return ArcOutline(circle.center, circle.start, circle.angle)
+}
+
+func (circle *CircleArc) Perimeter() float64 {
+    return PointsDistance(circle.start, circle.center) * circle.angle
+}
+
+func (circle *CircleArc) Contains(p image.Point) bool {
+    return false
+}
+
+func (circle *CircleArc) Area() float64 {
+    return 0
+}
+
+// Centroid of the arc line, on the bisector
+func (circle *CircleArc) Centroid() image.Point {
+    if circle.angle == 0 {
+        return circle.start
+    }
+    radius := PointsDistance(circle.start, circle.center)
+    dist := radius * math.Sin(circle.angle/2) / (circle.angle/2)
+    return CircleClosestPoint(circle.center, dist, RotatePoint(circle.start, circle.center, circle.angle/2), circle.center)
+}
+
+// Closest point on the circle, if inside the sweep, or the nearest end
+func (circle *CircleArc) ClosestPoint(p image.Point) image.Point {
+    delta := math.Fmod(Theta(p.Sub(circle.center)) - Theta(circle.start.Sub(circle.center)), 2*math.Pi)
+    if delta < 0 { delta += 2*math.Pi }
+    if delta <= circle.angle {
+        return CircleClosestPoint(circle.center, PointsDistance(circle.start, circle.center), p, circle.start)
+    }
+    end := RotatePoint(circle.start, circle.center, circle.angle)
+    if PointsDistance(p, end) < PointsDistance(p, circle.start) {
+        return end
+    }
+    return circle.start
+}
+
+// The end points, plus the extremes of the circle inside the sweep
+func (circle *CircleArc) Bounds() image.Rectangle {
+    points := new(list.List)
+    points.PushBack(circle.start)
+    points.PushBack(RotatePoint(circle.start, circle.center, circle.angle))
+    start_ang := Theta(circle.start.Sub(circle.center))
+    radius := PointsDistance(circle.start, circle.center)
+    for k := 0; k < 4; k++ {
+        ang := float64(k) * math.Pi / 2
+        delta := math.Fmod(ang - start_ang, 2*math.Pi)
+        if delta < 0 { delta += 2*math.Pi }
+        if delta <= circle.angle {
+            points.PushBack(circle.center.Add(image.Point{Round(radius*math.Cos(ang)), Round(radius*math.Sin(ang))}))
+        }
+    }
+    return PointsBounds(points)
+}
+
+const (
+    MOUSE_PRESS = 0
+    MOUSE_DRAG = 1
+    MOUSE_RELEASE = 2
+    MOUSE_MOVE = 3
+)
+
+// Distance the mouse must be dragged for the release to be a second
+// click. Shorter drags are a single click, as plain clicks
+const DRAG_THRESHOLD = 4
+
+type MouseEvent struct {
+    kind int
+    point image.Point
+}
+
+func MouseHandler(mousechan <-chan draw.Mouse) chan MouseEvent {
+    out := make(chan MouseEvent)
     go func() {
         clicked := false
         for {
             mouse := <-mousechan
-            if clicked == false && mouse.Buttons & 1<<0 == 1<<0 { // botao esquerdo
-                clicked = true
-                //fmt.Println("Click: ", mouse.X, ", ", mouse.Y)
-                out <- mouse.Point}
-            if clicked == true && mouse.Buttons & 1<<0 == 0 {
-                clicked = false
+            pressed := mouse.Buttons & 1<<0 == 1<<0 // botao esquerdo
+            kind := MOUSE_MOVE
+            switch {
+            case pressed && !clicked:
+                kind = MOUSE_PRESS
+            case pressed && clicked:
+                kind = MOUSE_DRAG
+            case !pressed && clicked:
+                kind = MOUSE_RELEASE
             }
+            clicked = pressed
+            out <- MouseEvent{kind, mouse.Point}
         }
     }()
     return out
 }
 
-func MouseClickFilters(in chan image.Point) chan image.Point {
+// Presses go out as clicks, and the release of a drag as a second one,
+// so dragging places the two points of a line, circle or window, or
+// takes an object to its destination. Drags, short releases and moves go
+// to the previews, dropping the oldest ones if nobody is looking. The
+// points are still on the screen: the goroutine reading them maps them
+// with Click and Motion, as it owns doc
+func SplitMouse(doc *Document, in chan MouseEvent) chan image.Point {
     out := make(chan image.Point)
     go func() {
+        var pressed image.Point
         for {
-            point := <-in
-            for elem := currentWindows.Front(); elem != nil; elem = elem.Next() {
-                window := elem.Value.(Window)
-                point = WindowClickFilter(window, point)
+            event := <-in
+            switch {
+            case event.kind == MOUSE_PRESS:
+                pressed = event.point
+                out <- event.point
+            case event.kind == MOUSE_RELEASE && PointsDistance(pressed, event.point) > DRAG_THRESHOLD:
+                out <- event.point
+            default:
+                select {
+                case doc.motion <- event:
+                default:
+                    select {
+                    case <-doc.motion:
+                    default:
+                    }
+                    doc.motion <- event
+                }
             }
-            out <-point
         }
     }()
     return out
@@ -810,19 +3968,294 @@ func WindowClickFilter(window Window, point image.Point) image.Point {
     return point
 }
 
-func CurrentFilters() (func(chan ColorPoint) chan ColorPoint) {
+/* Object snapping */
+
+const (
+    SNAP_ENDPOINT = 0
+    SNAP_MIDPOINT = 1
+    SNAP_CENTER = 2
+    SNAP_INTERSECTION = 3
+)
+
+type SnapTarget struct {
+    point image.Point
+    kind int
+}
+
+func (target SnapTarget) KindName() string {
+    switch target.kind {
+    case SNAP_ENDPOINT:
+        return "endpoint"
+    case SNAP_MIDPOINT:
+        return "midpoint"
+    case SNAP_CENTER:
+        return "center"
+    case SNAP_INTERSECTION:
+        return "intersection"
+    }
+    return "unknown"
+}
+
+// Point of the drawing under a click on the screen, snapped
+func (doc *Document) Click(point image.Point) image.Point {
+    doc.cursor = doc.Snap(doc.WindowsClickFilter(point), true)
+    return doc.cursor
+}
+
+// Point of the drawing under a drag or move of the mouse, snapped
+func (doc *Document) Motion(event MouseEvent) image.Point {
+    doc.cursor = doc.Snap(doc.WindowsClickFilter(event.point), false)
+    return doc.cursor
+}
+
+// Takes the moves of the mouse nobody looked at, to know the cursor
+func (doc *Document) FlushMotion() {
+    for {
+        select {
+        case event := <-doc.motion:
+            doc.Motion(event)
+        default:
+            return
+        }
+    }
+}
+
+func (doc *Document) WindowsClickFilter(point image.Point) image.Point {
+    for elem := doc.windows.Front(); elem != nil; elem = elem.Next() {
+        point = WindowClickFilter(elem.Value.(Window), point)
+    }
+    return point
+}
+
+// Moves point to the nearest snap target of the scene, drawing an
+// indicator on it when there is a screen. Points away from objects go
+// to the grid, if enabled
+func (doc *Document) Snap(point image.Point, verbose bool) image.Point {
+    if doc.snapMarker != nil {
+        EraseSnapMarker(doc, *doc.snapMarker, doc.indicators)
+        doc.snapMarker = nil
+    }
+    if doc.snap {
+        target, ok := doc.FindSnapTarget(point)
+        if ok {
+            if verbose {
+                fmt.Println("Snap:", target.KindName(), target.point)
+            }
+            if doc.indicators != nil {
+                doc.snapMarker = &target
+                doc.indicators <- doc.DrawChan(SnapMarker(target))
+            }
+            return target.point
+        }
+    }
+    if doc.grid.snap {
+        return doc.grid.Snap(point)
+    }
+    return point
+}
+
+func (doc *Document) FindSnapTarget(point image.Point) (SnapTarget, bool) {
+    var best SnapTarget
+    best_dist := float64(SNAP_RADIUS)
+    found := false
+    segments := new(list.List)
+    near := image.Rect(point.X - SNAP_RADIUS, point.Y - SNAP_RADIUS, point.X + SNAP_RADIUS + 1, point.Y + SNAP_RADIUS + 1)
+    if doc.sketch != nil {
+        for elem := doc.sketch.Front(); elem != nil; elem = elem.Next() {
+            p := elem.Value.(image.Point)
+            if dist := PointsDistance(point, p); dist <= best_dist {
+                best, best_dist, found = SnapTarget{p, SNAP_ENDPOINT}, dist, true
+            }
+        }
+    }
+    draws := doc.ZOrdered(doc.index.Query(near))
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        targets := drawable.SnapTargets()
+        for t := targets.Front(); t != nil; t = t.Next() {
+            target := t.Value.(SnapTarget)
+            dist := PointsDistance(point, target.point)
+            if dist <= best_dist {
+                best, best_dist, found = target, dist, true
+            }
+        }
+        // Only segments passing near the click can intersect near it
+        drawable_segments := drawable.Segments()
+        for s := drawable_segments.Front(); s != nil; s = s.Next() {
+            if s.Value.(Segment).DistanceTo(point) <= SNAP_RADIUS {
+                segments.PushBack(s.Value)
+            }
+        }
+    }
+    for s1 := segments.Front(); s1 != nil; s1 = s1.Next() {
+        for s2 := s1.Next(); s2 != nil; s2 = s2.Next() {
+            p, ok := SegmentIntersection(s1.Value.(Segment), s2.Value.(Segment))
+            if !ok { continue }
+            // Endpoints win ties, so shared vertices are not intersections
+            dist := PointsDistance(point, p)
+            if dist < best_dist {
+                best, best_dist, found = SnapTarget{p, SNAP_INTERSECTION}, dist, true
+            }
+        }
+    }
+    return best, found
+}
+
+// Indicator shape: square for endpoints, triangle for midpoints,
+// circle for centers and a cross for intersections
+func SnapMarker(target SnapTarget) Drawable {
+    p := target.point
+    figprops := FigProps{image.RGBAColor{0, 255, 255, 255}, SOLID, false}
+    switch target.kind {
+    case SNAP_MIDPOINT:
+        points := new(list.List)
+        points.PushBack(p.Add(image.Point{0, -SNAP_MARK}))
+        points.PushBack(p.Add(image.Point{SNAP_MARK, SNAP_MARK}))
+        points.PushBack(p.Add(image.Point{-SNAP_MARK, SNAP_MARK}))
+        return &Poligon{points, figprops, Id{0}}
+    case SNAP_CENTER:
+        return &RegularPoligon{p, p.Add(image.Point{SNAP_MARK, 0}), 8, figprops, Id{0}}
+    case SNAP_INTERSECTION:
+        draws := new(list.List)
+        draws.PushBack(&Line{p.Add(image.Point{-SNAP_MARK, -SNAP_MARK}), p.Add(image.Point{SNAP_MARK, SNAP_MARK}), figprops, Id{0}})
+        draws.PushBack(&Line{p.Add(image.Point{-SNAP_MARK, SNAP_MARK}), p.Add(image.Point{SNAP_MARK, -SNAP_MARK}), figprops, Id{0}})
+        return &Grouping{draws, Id{0}}
+    }
+    points := new(list.List)
+    points.PushBack(p.Add(image.Point{-SNAP_MARK, -SNAP_MARK}))
+    points.PushBack(p.Add(image.Point{SNAP_MARK, -SNAP_MARK}))
+    points.PushBack(p.Add(image.Point{SNAP_MARK, SNAP_MARK}))
+    points.PushBack(p.Add(image.Point{-SNAP_MARK, SNAP_MARK}))
+    return &Poligon{points, figprops, Id{0}}
+}
+
+// Restores what is under the indicator
+func EraseSnapMarker(doc *Document, target SnapTarget, indicators chan chan ColorPoint) {
+    doc.Refresh(RectExpand(SnapMarker(target).Bounds(), 1), indicators)
+}
+
+/* End object snapping */
+
+// Filters of the windows as they are now
+func (doc *Document) Filters() (func(chan ColorPoint) chan ColorPoint) {
+    windows := new(list.List)
+    windows.PushBackList(doc.windows)
     return func(in chan ColorPoint) chan ColorPoint {
-        for elem := currentWindows.Front(); elem != nil; elem = elem.Next() {
+        for elem := windows.Front(); elem != nil; elem = elem.Next() {
             in = WindowFilter(elem.Value.(Window))(in)
         }
         return FilterInvalidPoints(in)
     }
 }
 
-func RegisterWindow(window Window) {
-    currentWindows.PushBack(window)
+// Window with the corners of the source in any order
+func NewWindow(a image.Point, b image.Point, target image.Point, zoom float64) Window {
+    first := image.Point{a.X, a.Y}
+    last := image.Point{b.X, b.Y}
+    if first.X > last.X { first.X, last.X = last.X, first.X }
+    if first.Y > last.Y { first.Y, last.Y = last.Y, first.Y }
+    return Window{first, last, target, zoom, false}
+}
+
+// Takes out the window at pos, if from is not nil, and puts to in its
+// place, if not nil. Both places on the screen are repainted
+func (doc *Document) PutWindow(pos int, from *Window, to *Window, out chan chan ColorPoint) {
+    if from != nil {
+        if elem := doc.WindowElem(pos); elem != nil {
+            doc.windows.Remove(elem)
+        }
+    }
+    if to != nil {
+        if elem := doc.WindowElem(pos); elem != nil {
+            doc.windows.InsertBefore(*to, elem)
+        } else {
+            doc.windows.PushBack(*to)
+        }
+    }
+    if from != nil {
+        doc.RepaintWindow(*from, out)
+    }
+    if to != nil {
+        doc.RepaintWindow(*to, out)
+    }
+}
+
+func (doc *Document) RepaintWindow(window Window, out chan chan ColorPoint) {
+    out <- doc.Render(window.SourceRect())
+    out <- doc.Render(window.TargetRect())
+}
+
+// Element of the window at pos, counting from 0
+func (doc *Document) WindowElem(pos int) *list.Element {
+    i := 0
+    for elem := doc.windows.Front(); elem != nil; elem = elem.Next() {
+        if i == pos {
+            return elem
+        }
+        i++
+    }
+    return nil
+}
+
+// Position of the topmost window with a border within SEARCH_RADIUS of
+// point, or -1
+func (doc *Document) WindowAt(point image.Point) int {
+    found := -1
+    i := 0
+    for elem := doc.windows.Front(); elem != nil; elem = elem.Next() {
+        if elem.Value.(Window).BorderDistance(point) <= SEARCH_RADIUS {
+            found = i
+        }
+        i++
+    }
+    return found
+}
+
+func (doc *Document) SelectWindow(pos int, selected bool, out chan chan ColorPoint) {
+    elem := doc.WindowElem(pos)
+    window := elem.Value.(Window)
+    if window.selected == selected { return }
+    window.selected = selected
+    elem.Value = window
+    doc.RepaintWindow(window, out)
+}
+
+// Positions of the selected windows, from the last
+func (doc *Document) SelectedWindows() *list.List {
+    selected := new(list.List)
+    i := 0
+    for elem := doc.windows.Front(); elem != nil; elem = elem.Next() {
+        if elem.Value.(Window).selected {
+            selected.PushFront(i)
+        }
+        i++
+    }
+    return selected
+}
+
+func (doc *Document) DeleteWindow(pos int, out chan chan ColorPoint) {
+    window := doc.WindowElem(pos).Value.(Window)
+    op := &WindowOp{pos, &window, nil}
+    op.Redo(doc, out)
+    doc.Record(op)
+}
+
+func (doc *Document) PrintWindows() {
+    if doc.windows.Len() == 0 {
+        fmt.Println("Nenhuma janela")
+    }
+    i := 1
+    for elem := doc.windows.Front(); elem != nil; elem = elem.Next() {
+        window := elem.Value.(Window)
+        flags := ""
+        if window.selected { flags = " (selecionada)" }
+        fmt.Println(i, "origem", window.first, window.last, "destino", window.target, "zoom", window.zoom, flags)
+        i++
+    }
 }
 
+// Hides what is behind the target and the border of the window. The
+// magnified copy is drawn by MagnifiedChan
 func WindowFilter(window Window) (func (chan ColorPoint) chan ColorPoint) {
     return func(in chan ColorPoint) chan ColorPoint {
         out := make(chan ColorPoint, BUF_SIZE)
@@ -836,17 +4269,50 @@ func WindowFilter(window Window) (func (chan ColorPoint) chan ColorPoint) {
                 if window.PointInBorder(cp.point) {
                     continue
                 }
-                // If in window, copy to towindow
-                if window.PointIn(cp.point) {
-                    newpoint := window.TransferPoint(cp.point)
-                    for x:=0; x<window.zoom; x++ {
-                        for y:=0; y<window.zoom; y++ {
-                            delta := image.Point{x, y}
-                            out <- ColorPoint{newpoint.Add(delta), cp.color, cp.drawable}
+                out <- cp
+            }
+            close(out)
+        }()
+        return out
+    }
+}
+
+// Points of drawable on the screen, hidden behind the windows, and its
+// copies magnified inside them
+func (doc *Document) DrawChan(drawable Drawable) chan ColorPoint {
+    return doc.Painter()(drawable)
+}
+
+// DrawChan with the windows as they are now, for drawing later from
+// another goroutine
+func (doc *Document) Painter() (func(Drawable) chan ColorPoint) {
+    filters := doc.Filters()
+    windows := new(list.List)
+    windows.PushBackList(doc.windows)
+    return func(drawable Drawable) chan ColorPoint {
+        out := make(chan ColorPoint, BUF_SIZE)
+        in := filters(drawable.PointChan())
+        go func() {
+            for ! closed(in) {
+                cp := <-in
+                if closed(in) { break }
+                out <- cp
+            }
+            bounds := RectExpand(drawable.Bounds(), 1)
+            i := 0
+            for elem := windows.Front(); elem != nil; elem = elem.Next() {
+                window := elem.Value.(Window)
+                if RectOverlaps(bounds, window.SourceRect()) {
+                    magnified := window.MagnifiedChan(drawable)
+                    for ! closed(magnified) {
+                        cp := <-magnified
+                        if closed(magnified) { break }
+                        if cp.Valid() && !BehindOtherWindow(windows, i, cp.point) {
+                            out <- cp
                         }
                     }
                 }
-                out <- cp
+                i++
             }
             close(out)
         }()
@@ -854,6 +4320,20 @@ func WindowFilter(window Window) (func (chan ColorPoint) chan ColorPoint) {
     }
 }
 
+// Whether point is under the target or border of a window other than
+// the one at index skip
+func BehindOtherWindow(windows *list.List, skip int, point image.Point) bool {
+    i := 0
+    for elem := windows.Front(); elem != nil; elem = elem.Next() {
+        window := elem.Value.(Window)
+        if i != skip && (window.PointInTarget(point) || window.PointInBorder(point)) {
+            return true
+        }
+        i++
+    }
+    return false
+}
+
 func FilterInvalidPoints(in chan ColorPoint) (out chan ColorPoint) {
     out = make(chan ColorPoint, BUF_SIZE)
     go func() {
@@ -870,90 +4350,400 @@ func FilterInvalidPoints(in chan ColorPoint) (out chan ColorPoint) {
 }
 
 
-func EventProcessor (clickchan <-chan image.Point, kbchan chan int) chan chan ColorPoint {
+func EventProcessor (doc *Document, clickchan <-chan image.Point, kbchan chan int) chan chan ColorPoint {
     out := make(chan chan ColorPoint)
     go func() {
         for {
             select {
             case keyevent := <-kbchan:
                 fmt.Println("Apertou: ", keyevent)
+                doc.ResetHitCycle()
                 switch keyevent {
                 case 'l':
-                    LineCreator(clickchan, kbchan, out)
+                    LineCreator(doc, clickchan, kbchan, out)
                     break
                 case 'c':
-                    SetColor(kbchan)
+                    SetColor(doc, kbchan, out)
                     break
                 case 'd':
-                    DeleteHandler(clickchan, kbchan, out)
+                    DeleteHandler(doc, clickchan, kbchan, out)
                     break
                 case 'p':
-                    PoligonCreator(clickchan, kbchan, out)
+                    PoligonCreator(doc, clickchan, kbchan, out)
                 case 'r':
-                    RegularPoligonCreator(clickchan, kbchan, out, currentCounter)
+                    RegularPoligonCreator(doc, clickchan, kbchan, out, doc.counter)
                 case 'o':
-                    CircleCreator(clickchan, kbchan, out)
+                    CircleCreator(doc, clickchan, kbchan, out)
                 case 'a':
-                    CircleArcCreator(clickchan, kbchan, out)
+                    CircleArcCreator(doc, clickchan, kbchan, out)
                 case '+':
-                    currentCounter++
-                    fmt.Println("Contador Generico: ", currentCounter)
+                    doc.counter++
+                    fmt.Println("Contador Generico: ", doc.counter)
                 case '-':
-                    currentCounter--
-                    fmt.Println("Contador Generico: ", currentCounter)
+                    doc.counter--
+                    fmt.Println("Contador Generico: ", doc.counter)
                 case 'm':
-                    MoveHandler(clickchan, kbchan, out)
+                    MoveHandler(doc, clickchan, kbchan, out)
                 case 't':
-                    DashHandler()
+                    DashHandler(doc, out)
                 case 'b':
-                    ThickHandler()
+                    ThickHandler(doc, out)
                 case 'g':
-                    RotateHandler(clickchan, kbchan, out)
+                    RotateHandler(doc, clickchan, kbchan, out)
                 case 'z':
-                    MirrorHandler(clickchan, kbchan, out)
+                    MirrorHandler(doc, clickchan, kbchan, out)
                 case 'w':
-                    GroupingHandler(clickchan, kbchan, out)
+                    GroupingHandler(doc, clickchan, kbchan, out)
                 case 'q':
-                    WindowCreator(clickchan, kbchan, out)
+                    WindowCreator(doc, clickchan, kbchan, out)
+                case 'Q':
+                    WindowHandler(doc, clickchan, kbchan, out)
                 case 'y':
-                    DegroupingHandler(clickchan, kbchan, out)
+                    DegroupingHandler(doc, clickchan, kbchan, out)
+                case 'k':
+                    SnapHandler(doc, clickchan, kbchan, out)
+                case 'x':
+                    AngleConstraintHandler(doc, kbchan)
+                case 'n':
+                    AlignHandler(doc, clickchan, kbchan, out)
+                case 'i':
+                    InfoHandler(doc, clickchan, kbchan)
+                case 'f':
+                    out <- doc.Render(screenRect)
+                case 'h':
+                    ZOrderHandler(doc, clickchan, kbchan, out)
+                case 'e':
+                    LayerHandler(doc, clickchan, kbchan, out)
+                case 'u':
+                    doc.Undo(out)
+                case 'U':
+                    doc.Redo(out)
+                case 'H':
+                    HistoryLimitHandler(doc, clickchan, kbchan)
+                case 's':
+                    SelectHandler(doc, clickchan, kbchan, out)
+                case 'v':
+                    NodeEditHandler(doc, clickchan, kbchan, out)
+                case 'j':
+                    TransformHandler(doc, clickchan, kbchan, out)
+                case 'A':
+                    ArrayHandler(doc, clickchan, kbchan, out)
+                case 'B':
+                    BooleanHandler(doc, clickchan, kbchan, out)
+                case 'C', 'X', 'V', 'D':
+                    ClipboardHandler(doc, clickchan, kbchan, out, keyevent)
                 }
+            case event := <-doc.motion:
+                doc.Motion(event)
             case <-clickchan:
                fmt.Println("Outro clique")
             }
         }
-    }()
-
-   return out
+    }()
+
+   return out
+}
+
+
+func DegroupingHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Desagrupar Grupamento")
+    for {
+    select {
+        case p := <-clickchan:
+            p = doc.Click(p)
+            drawable, _ := doc.SearchNearPoint(p)
+            group, ok := drawable.(*Grouping)
+            if drawable != nil && ok && doc.Editable(drawable) {
+                group.Degrouping(doc, out)
+                return
+            }
+        case <-kbchan:
+            return
+    }
+    }
+}
+
+// Click toggles an object, or a window by its border, a click on empty
+// space and another one select the objects and windows inside that
+// rectangle, 'a' selects all and 'c' clears the
+// selection. 'l' selects the objects inside a lasso and 'f' the ones
+// crossed by a fence, both traced by clicks. Any other key ends
+func SelectHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Selecionar objetos")
+    var corner *image.Point
+    for {
+        select {
+        case p := <-clickchan:
+            p = doc.Click(p)
+            if corner != nil {
+                points := new(list.List)
+                points.PushBack(*corner)
+                points.PushBack(p)
+                rect := PointsBounds(points)
+                draws := doc.ZOrdered(doc.index.Query(rect))
+                for elem := draws.Front(); elem != nil; elem = elem.Next() {
+                    if RectContains(rect, elem.Value.(Drawable).Bounds()) {
+                        doc.Select(elem.Value.(Drawable), out)
+                    }
+                }
+                i := 0
+                for elem := doc.windows.Front(); elem != nil; elem = elem.Next() {
+                    if RectContains(rect, elem.Value.(Window).SourceRect()) {
+                        doc.SelectWindow(i, true, out)
+                    }
+                    i++
+                }
+                corner = nil
+                break
+            }
+            drawable, _ := doc.SearchNearPoint(p)
+            if drawable == nil {
+                if pos := doc.WindowAt(p); pos >= 0 {
+                    window := doc.WindowElem(pos).Value.(Window)
+                    doc.SelectWindow(pos, !window.selected, out)
+                    break
+                }
+                corner = &p
+                fmt.Println("Canto 1:", p)
+            } else if doc.IsSelected(drawable) {
+                doc.Deselect(drawable, out)
+            } else {
+                doc.Select(drawable, out)
+            }
+        case key := <-kbchan:
+            switch key {
+            case 'a':
+                draws := doc.All()
+                for elem := draws.Front(); elem != nil; elem = elem.Next() {
+                    doc.Select(elem.Value.(Drawable), out)
+                }
+                for i := 0; i < doc.windows.Len(); i++ {
+                    doc.SelectWindow(i, true, out)
+                }
+            case 'c':
+                doc.ClearSelection(out)
+            case 'l', 'f':
+                path := doc.TracePath(clickchan, kbchan, out)
+                draws := doc.ZOrdered(doc.index.Query(PointsBounds(path)))
+                for elem := draws.Front(); elem != nil; elem = elem.Next() {
+                    drawable := elem.Value.(Drawable)
+                    if key == 'l' && PathEncloses(path, drawable) ||
+                       key == 'f' && PolylineCrosses(path, drawable) {
+                        doc.Select(drawable, out)
+                    }
+                }
+            default:
+                fmt.Println(doc.Selected().Len(), "objetos selecionados")
+                if windows := doc.SelectedWindows(); windows.Len() > 0 {
+                    fmt.Println(windows.Len(), "janelas selecionadas")
+                }
+                return
+            }
+        }
+    }
+    return
+}
+
+// Points clicked until a key is pressed, shown while being traced
+func (doc *Document) TracePath(clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) *list.List {
+    fmt.Println("Clique os pontos, qualquer tecla termina")
+    points := new(list.List)
+    props := FigProps{selectionColor, DOTTED, false}
+    for {
+        select {
+        case p := <-clickchan:
+            p = doc.Click(p)
+            if points.Len() > 0 {
+                line := Line{points.Back().Value.(image.Point), p, props, Id{0}}
+                out <- doc.DrawChan(&line)
+            }
+            points.PushBack(p)
+        case <-kbchan:
+            if points.Len() > 0 {
+                doc.Refresh(RectExpand(PointsBounds(points), 1), out)
+            }
+            return points
+        }
+    }
+    return points
+}
+
+// Reshapes the clicked object by its handles. A click on a handle and
+// another one move it, 'i' and a click insert a vertex on the nearest
+// edge, 'd' deletes the chosen vertex. Any other key ends
+func NodeEditHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Editar vertices")
+    var drawable Drawable
+    for drawable == nil {
+        select {
+        case p := <-clickchan:
+            p = doc.Click(p)
+            picked, _ := doc.SearchNearPoint(p)
+            if picked != nil && doc.Editable(picked) && Handles(picked).Len() > 0 {
+                drawable = picked
+            }
+        case <-kbchan:
+            return
+        }
+    }
+    active := -1
+    inserting := false
+    defer doc.ClearPreview()
+    doc.SetPreview(func(p image.Point) Drawable {
+        if active < 0 || inserting { return nil }
+        edited := drawable.Clone()
+        SetHandle(edited, active, p)
+        return edited
+    }, out)
+    shown := doc.ShowHandles(drawable, active, out)
+    for {
+        select {
+        case event := <-doc.motion:
+            doc.ShowPreview(doc.Motion(event))
+            continue
+        case p := <-clickchan:
+            p = doc.Click(p)
+            doc.HidePreview()
+            edited := drawable.Clone()
+            edited.SetId(drawable.GetId())
+            changed := false
+            if inserting {
+                changed = InsertVertex(edited, p)
+                inserting = false
+            } else if active >= 0 {
+                SetHandle(edited, active, p)
+                changed = true
+                active = -1
+            } else {
+                active = NearestHandle(Handles(drawable), p)
+            }
+            if changed {
+                doc.Replace(drawable, edited, out)
+                drawable = edited
+            }
+        case key := <-kbchan:
+            switch key {
+            case 'i':
+                fmt.Println("Clique na aresta")
+                inserting = true
+            case 'd':
+                edited := drawable.Clone()
+                edited.SetId(drawable.GetId())
+                if active >= 0 && DeleteVertex(edited, active) {
+                    doc.Replace(drawable, edited, out)
+                    drawable = edited
+                }
+                active = -1
+            default:
+                doc.Refresh(shown, out)
+                return
+            }
+        }
+        doc.Refresh(shown, out)
+        shown = doc.ShowHandles(drawable, active, out)
+    }
+    return
 }
 
-
-func DegroupingHandler (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
-    fmt.Println("Desagrupar Grupamento")
-    for {
-    select {
+// Resizes and rotates the selection, or the clicked object, by handles
+// around its bounding box. A click on a handle and another one drag it:
+// corners and sides scale, the handle above rotates about the pivot and
+// the pivot handle moves the pivot. Return applies all the changes as a
+// single operation, any other key cancels
+func TransformHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Transformar objetos")
+    draws := doc.SelectedEditables()
+    for draws.Len() == 0 {
+        select {
         case p := <-clickchan:
-            drawable, _ := SearchNearPoint(p)
-            group, ok := drawable.(*Grouping)
-            if drawable != nil && ok {
-                go group.Degrouping(out)
-                return
+            p = doc.Click(p)
+            drawable, _ := doc.SearchNearPoint(p)
+            if drawable != nil && doc.Editable(drawable) {
+                draws.PushBack(drawable)
             }
         case <-kbchan:
             return
+        }
+    }
+    copies := new(list.List)
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        clone := drawable.Clone()
+        clone.SetId(drawable.GetId())
+        copies.PushBack(clone)
     }
+    pivot := RectCenter(DrawablesBounds(copies))
+    custom_pivot := false
+    active := -1
+    defer doc.ClearPreview()
+    doc.SetPreview(func(p image.Point) Drawable {
+        if active == HANDLE_PIVOT {
+            return HandleMarker(p, activeHandleColor)
+        }
+        if active < 0 { return nil }
+        moved := new(list.List)
+        for elem := copies.Front(); elem != nil; elem = elem.Next() {
+            moved.PushBack(elem.Value.(Drawable).Clone())
+        }
+        doc.ApplyHandle(moved, pivot, active, p)
+        return &Grouping{moved, Id{0}}
+    }, out)
+    shown := doc.ShowTransform(copies, pivot, active, out)
+    for {
+        select {
+        case event := <-doc.motion:
+            doc.ShowPreview(doc.Motion(event))
+            continue
+        case p := <-clickchan:
+            p = doc.Click(p)
+            doc.HidePreview()
+            box := DrawablesBounds(copies)
+            if active < 0 {
+                active = NearestHandle(BoxHandles(box, pivot), p)
+                break
+            }
+            if active == HANDLE_PIVOT {
+                pivot = p
+                custom_pivot = true
+            } else {
+                doc.ApplyHandle(copies, pivot, active, p)
+            }
+            if !custom_pivot {
+                pivot = RectCenter(DrawablesBounds(copies))
+            }
+            active = -1
+        case key := <-kbchan:
+            doc.HidePreview()
+            doc.Refresh(shown, out)
+            if key != KEY_RETURN && key != '\r' && key != '\n' {
+                fmt.Println("Transformacao cancelada")
+                return
+            }
+            doc.Begin()
+            elem := draws.Front()
+            for c := copies.Front(); c != nil; c = c.Next() {
+                doc.Replace(elem.Value.(Drawable), c.Value.(Drawable), out)
+                elem = elem.Next()
+            }
+            doc.Commit()
+            return
+        }
+        doc.Refresh(shown, out)
+        shown = doc.ShowTransform(copies, pivot, active, out)
     }
+    return
 }
 
-func GroupingHandler (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+func GroupingHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
     fmt.Println("Agrupando objetos")
-    draws := new(list.List)
-    for_breaker := false
-    for {
+    draws := doc.SelectedEditables()
+    for_breaker := draws.Len() > 0
+    for !for_breaker {
         select{
         case p := <-clickchan:
-            drawable, _ := SearchNearPoint(p)
-            if drawable != nil {
+            p = doc.Click(p)
+            drawable, _ := doc.SearchNearPoint(p)
+            if drawable != nil && doc.Editable(drawable) {
                 draws.PushBack(drawable)
             }
         case <-kbchan:
@@ -961,16 +4751,175 @@ func GroupingHandler (clickchan <-chan image.Point, kbchan chan int, out chan ch
         }
         if for_breaker { break }
     }
-    counter_id++
-    group := Grouping{draws, Id{counter_id}}
-    group.DeleteOriginals(out)
-    out <- RegisterPoints(CurrentFilters()(group.PointChan()), &group)
+    if draws.Len() == 0 { return }
+    group := Grouping{draws, Id{doc.NewId()}}
+    doc.Begin()
+    group.DeleteOriginals(doc, out)
+    doc.Add(&group, out)
+    doc.Commit()
+    if doc.selection.Len() > 0 {
+        doc.ClearSelection(out)
+        doc.Select(&group, out)
+    }
+}
+
+// Layer commands. A digit activates that layer, 'n' adds a layer with
+// the typed name, 'v' shows or hides the active layer, 'b' locks or
+// unlocks it, 'u' and 'd' move it up and down, and 'm' moves the clicked
+// objects into it
+func LayerHandler(doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Camadas")
+    doc.PrintLayers()
+    key := <-kbchan
+    switch key {
+    case 'n':
+        fmt.Println("Nome da camada:")
+        name, ok := ReadInput(<-kbchan, kbchan)
+        if !ok { return }
+        if name == "" {
+            name = fmt.Sprint("Camada ", doc.layers.Len() + 1)
+        }
+        doc.active = doc.AddLayer(name)
+    case 'v':
+        doc.active.visible = !doc.active.visible
+        out <- doc.Render(screenRect)
+    case 'b':
+        doc.active.locked = !doc.active.locked
+    case 'u', 'd':
+        for l := doc.layers.Front(); l != nil; l = l.Next() {
+            if l.Value.(*Layer) != doc.active { continue }
+            next, prev := l.Next(), l.Prev()
+            if key == 'u' && next != nil {
+                doc.layers.Remove(l)
+                doc.layers.InsertAfter(doc.active, next)
+            } else if key == 'd' && prev != nil {
+                doc.layers.Remove(l)
+                doc.layers.InsertBefore(doc.active, prev)
+            }
+            break
+        }
+        out <- doc.Render(screenRect)
+    case 'm':
+        fmt.Println("Mover objetos para", doc.active.name)
+        doc.Begin()
+        for_breaker := false
+        for {
+            select {
+            case p := <-clickchan:
+                p = doc.Click(p)
+                drawable, _ := doc.SearchNearPoint(p)
+                if drawable != nil {
+                    doc.MoveToLayer(drawable, doc.active, out)
+                }
+            case <-kbchan:
+                for_breaker = true
+            }
+            if for_breaker { break }
+        }
+        doc.Commit()
+    default:
+        if key >= '1' && key <= '9' {
+            layer := doc.LayerAt(key - '0')
+            if layer == nil { return }
+            doc.active = layer
+        }
+    }
+    doc.PrintLayers()
+}
+
+func SnapHandler(doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    old := doc.grid
+    switch <- kbchan {
+    case 'o':
+        doc.snap = !doc.snap
+        if doc.snap {
+            fmt.Println("Object snap: on")
+        } else {
+            fmt.Println("Object snap: off")
+        }
+        return
+    case 'g':
+        doc.grid.visible = !doc.grid.visible
+        if doc.grid.visible {
+            fmt.Println("Grid: on")
+        } else {
+            fmt.Println("Grid: off")
+        }
+    case 's':
+        doc.grid.snap = !doc.grid.snap
+        if doc.grid.snap {
+            fmt.Println("Grid snap: on")
+        } else {
+            fmt.Println("Grid snap: off")
+        }
+        return
+    case 'e':
+        if doc.counter < 2 {
+            fmt.Println("Espacamento invalido:", doc.counter)
+            return
+        }
+        doc.grid.spacing = doc.counter
+        fmt.Println("Grid spacing:", doc.grid.spacing)
+    case 'c':
+        fmt.Println("Origem da grade")
+        select {
+        case p := <-clickchan:
+            p = doc.Click(p)
+            doc.grid.origin = p
+            fmt.Println("Grid origin:", p)
+        case <-kbchan:
+            return
+        }
+    default:
+        return
+    }
+    if old.visible || doc.grid.visible {
+        out <- doc.Render(screenRect)
+    }
+}
+
+func AngleConstraintHandler(doc *Document, kbchan chan int) {
+    switch <- kbchan {
+    case 'x':
+        doc.angleConstraint = !doc.angleConstraint
+        if doc.angleConstraint {
+            fmt.Println("Angle constraint: on,", doc.angleStep, "degrees")
+        } else {
+            fmt.Println("Angle constraint: off")
+        }
+    case 'e':
+        if doc.counter <= 0 {
+            fmt.Println("Angulo invalido:", doc.counter)
+            return
+        }
+        doc.angleStep = doc.counter
+        fmt.Println("Angle step:", doc.angleStep, "degrees")
+    }
+}
+
+// Prints the measures of an object
+func InfoHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int) {
+    fmt.Println("Medir objeto")
+    p, ok := doc.NextPoint(clickchan, kbchan, nil)
+    if !ok {
+        return
+    }
+    drawable, _ := doc.SearchNearPoint(p)
+    if drawable == nil {
+        return
+    }
+    fmt.Printf("Objeto: %T %d\n", drawable, drawable.GetId())
+    fmt.Println("Bounds:", drawable.Bounds())
+    fmt.Println("Perimeter:", drawable.Perimeter())
+    fmt.Println("Area:", drawable.Area())
+    fmt.Println("Centroid:", drawable.Centroid())
 }
 
-func DashHandler() {
-    currentDashStyle ++
-    currentDashStyle %= 3
-    switch currentDashStyle {
+func DashHandler(doc *Document, out chan chan ColorPoint) {
+    before := doc.style
+    doc.style.dotted ++
+    doc.style.dotted %= 3
+    switch doc.style.dotted {
     case SOLID:
         fmt.Println("Style: solid")
     case DOTTED:
@@ -978,203 +4927,287 @@ func DashHandler() {
     case DASHED:
         fmt.Println("Style: dashed")
     }
+    dotted := doc.style.dotted
+    doc.Begin()
+    doc.Record(&StyleOp{before, doc.style})
+    doc.RestyleSelection(func(props *FigProps) { props.dotted = dotted }, out)
+    doc.Commit()
 }
 
-func ThickHandler() {
-    if currentThick {
-        currentThick = false
+func ThickHandler(doc *Document, out chan chan ColorPoint) {
+    before := doc.style
+    if doc.style.thick {
+        doc.style.thick = false
         fmt.Println("Thick: no")
     } else {
-        currentThick = true
+        doc.style.thick = true
         fmt.Println("Thick: yes")
     }
+    thick := doc.style.thick
+    doc.Begin()
+    doc.Record(&StyleOp{before, doc.style})
+    doc.RestyleSelection(func(props *FigProps) { props.thick = thick }, out)
+    doc.Commit()
 }
 
-func CircleCreator (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+func CircleCreator (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
     fmt.Println("Desenhar Circulo")
+    defer doc.ClearPreview()
     points := [2]image.Point{}
-    for_breaker := false
-    for i := 0; i < 2; i++ {
-        select {
-        case p := <-clickchan:
-            fmt.Println("Ponto para circulo")
-            points[i] = p
-        case <-kbchan:
-            for_breaker = true
-            break
+    for i := 0; i < 2; {
+        if i == 1 {
+            doc.SetPreview(func(p image.Point) Drawable {
+                return &Circle{points[0], p, doc.style, Id{0}}
+            }, out)
         }
-        if for_breaker {
-            break
+        input := doc.NextInput(clickchan, kbchan, nil)
+        switch input.kind {
+        case INPUT_CANCEL:
+            return
+        case INPUT_NUMBER:
+            // Typed radius
+            if i == 0 { continue }
+            input.point = points[0].Add(image.Point{Round(input.value), 0})
         }
+        fmt.Println("Ponto para circulo")
+        points[i] = input.point
+        i++
     }
-    counter_id++
-    circle := Circle{points[0], points[1], CurrentFigProps(), Id{counter_id}}
-    out <- RegisterPoints(CurrentFilters()(circle.PointChan()), &circle)
+    circle := Circle{points[0], points[1], doc.style, Id{doc.NewId()}}
+    doc.Add(&circle, out)
 }
 
-func CircleArcCreator (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+func CircleArcCreator (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
     fmt.Println("Desenhar Arco")
+    defer doc.ClearPreview()
     points := [3]image.Point{}
-    for_breaker := false
-    for i := 0; i < 3; i++ {
-        select {
-        case p := <-clickchan:
-            fmt.Println("Ponto para arco")
-            points[i] = p
-        case <-kbchan:
-            for_breaker = true
-            break
+    var angle float64
+    for i := 0; i < 3; {
+        switch i {
+        case 1:
+            doc.SetPreview(func(p image.Point) Drawable {
+                return &Line{points[0], p, doc.style, Id{0}}
+            }, out)
+        case 2:
+            doc.SetPreview(func(p image.Point) Drawable {
+                sweep := Angle(points[0], points[1], p)
+                if sweep <= 0 { sweep += 2*math.Pi }
+                return &CircleArc{points[0], points[1], sweep, doc.style, Id{0}}
+            }, out)
         }
-        if for_breaker {
+        input := doc.NextInput(clickchan, kbchan, nil)
+        if input.kind == INPUT_CANCEL {
+            return
+        }
+        if input.kind == INPUT_NUMBER {
+            if i < 2 { continue }
+            // Typed sweep, counterclockwise from the start point
+            angle = input.value * math.Pi / 180
+            if angle == 0 {
+                fmt.Println("Angulo invalido:", input.value)
+                continue
+            }
+            if angle > 0 {
+                points[1] = RotatePoint(points[1], points[0], -angle)
+            } else {
+                // Clockwise: the same arc with its ends swapped
+                angle = -angle
+            }
             break
         }
+        fmt.Println("Ponto para arco")
+        points[i] = input.point
+        i++
+        if i == 3 {
+            angle = Angle(points[0], points[1], points[2])
+        }
     }
-    counter_id++
-    angle := Angle(points[0], points[1], points[2])
     //fmt.Println("Angulo: ", angle)
     var ca CircleArc
     if angle > 0 {
-      ca = CircleArc{points[0], points[1], angle, CurrentFigProps(), Id{counter_id}}
+      ca = CircleArc{points[0], points[1], angle, doc.style, Id{doc.NewId()}}
     } else {
-      ca = CircleArc{points[0], points[1], angle+2*math.Pi, CurrentFigProps(), Id{counter_id}}
+      ca = CircleArc{points[0], points[1], angle+2*math.Pi, doc.style, Id{doc.NewId()}}
     }
-    out <- RegisterPoints(CurrentFilters()(ca.PointChan()), &ca)
+    doc.Add(&ca, out)
 }
 
-func RegularPoligonCreator (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint, sides int) {
-    if sides < 3 {
-        fmt.Println("Numero de lados invalido, lados:", sides)
-        return
-    }
+func RegularPoligonCreator (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint, sides int) {
     fmt.Println("Desenhar Poligono Regular")
+    defer doc.ClearPreview()
     points := [2]image.Point{}
-    for_breaker := false
-    for i := 0; i < 2; i++ {
-        select {
-        case p := <-clickchan:
-            fmt.Println("Ponto para poligono regular")
-            points[i] = p
-        case <-kbchan:
-            for_breaker = true
-            break
+    for i := 0; i < 2; {
+        if i == 1 {
+            doc.SetPreview(func(p image.Point) Drawable {
+                if sides < 3 { return nil }
+                return &RegularPoligon{points[0], p, sides, doc.style, Id{0}}
+            }, out)
         }
-        if for_breaker {
-            break
+        input := doc.NextInput(clickchan, kbchan, nil)
+        switch input.kind {
+        case INPUT_CANCEL:
+            return
+        case INPUT_NUMBER:
+            sides = int(input.value)
+            fmt.Println("Lados:", sides)
+            continue
         }
+        fmt.Println("Ponto para poligono regular")
+        points[i] = input.point
+        i++
+    }
+    if sides < 3 {
+        fmt.Println("Numero de lados invalido, lados:", sides)
+        return
     }
-    counter_id++
-    regpol := RegularPoligon{points[0], points[1], sides, CurrentFigProps(), Id{counter_id}}
-    out <- RegisterPoints(CurrentFilters()(regpol.PointChan()), &regpol)
+    regpol := RegularPoligon{points[0], points[1], sides, doc.style, Id{doc.NewId()}}
+    doc.Add(&regpol, out)
 }
 
-func PoligonCreator (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+func PoligonCreator (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
     fmt.Println("Desenhar Poligono")
     points := new(list.List)
     i := 0
-    for_breaker := false
     var p1 image.Point
     var p2 image.Point
-    poligon := Poligon{points, CurrentFigProps(), Id{0}}
+    poligon := Poligon{points, doc.style, Id{0}}
+    // Its vertices can be snapped to while it is drawn
+    doc.sketch = points
+    defer func() { doc.sketch = nil }()
+    defer doc.ClearPreview()
     for i = 0 ; i < 50; i++ {
-        select {
-        case p := <-clickchan:
-            fmt.Println("Ponto para poligono")
-            points.PushBack(p)
-            if i > 0 {
-                p1 = p2
-                p2 = p
-                line := Line{p1, p2, CurrentFigProps(), Id{0}}
-                out <- RegisterPoints(CurrentFilters()(line.PointChan()), &poligon)
-            } else {
-                p2 = p
-            }
-        case <- kbchan:
-            for_breaker = true
-            break
+        var from *image.Point
+        if i > 0 {
+            from = &p2
+            doc.SetPreview(func(p image.Point) Drawable {
+                return &Line{p2, p, doc.style, Id{0}}
+            }, out)
         }
-        if for_breaker {
+        p, ok := doc.NextPoint(clickchan, kbchan, from)
+        if !ok {
             break
         }
+        fmt.Println("Ponto para poligono")
+        points.PushBack(p)
+        if i > 0 {
+            p1 = p2
+            p2 = p
+            line := Line{p1, p2, doc.style, Id{0}}
+            out <- doc.DrawChan(&line)
+        } else {
+            p2 = p
+        }
     }
-    if i > 0 {
-        line := Line{points.Back().Value.(image.Point), points.Front().Value.(image.Point), CurrentFigProps(), Id{0}}
-        out <- RegisterPoints(CurrentFilters()(line.PointChan()), &poligon)
+    doc.ClearPreview()
+    if points.Len() >= 3 {
+        doc.Add(&poligon, out)
+    } else if points.Len() > 0 {
+        fmt.Println("Poligono precisa de 3 pontos")
+        doc.Refresh(RectExpand(PointsBounds(points), 1), out)
     }
-    counter_id++
-    (&poligon).SetId(counter_id)
 }
 
-func RotateHandler (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+func RotateHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
     fmt.Println("Rotacionar objeto")
     state := 0
-    var drawable Drawable
+    draws := doc.SelectedEditables()
+    if draws.Len() > 0 { state = 1 }
     var origin image.Point
     var point1 image.Point
     var point2 image.Point
+    var angle float64
     for {
-        select{
-        case p := <-clickchan:
-            switch(state){
-            case 0:
-                drawable, _ = SearchNearPoint(p)
-                if drawable != nil { state = 1 }
-                break
-            case 1:
-                origin = p
-                fmt.Println("Origem:", origin)
-                state = 2
-                break
-            case 2:
-                point1 = p
-                fmt.Println("Ponto 1:", point1)
-                state = 3
-                break
-            case 3:
-                point2 = p
-                fmt.Println("Ponto 2:", point2)
-                state = 4
-            }
-        case <-kbchan:
+        input := doc.NextInput(clickchan, kbchan, nil)
+        if input.kind == INPUT_CANCEL {
             return
         }
-        if state == 4 { break }
+        p := input.point
+        if input.kind == INPUT_NUMBER {
+            // Typed angle, counterclockwise
+            if state != 2 { continue }
+            angle = -input.value * math.Pi / 180
+            fmt.Println("Angulo:", input.value)
+            break
+        }
+        switch(state){
+        case 0:
+            drawable, _ := doc.SearchNearPoint(p)
+            if drawable != nil && doc.Editable(drawable) {
+                draws.PushBack(drawable)
+                state = 1
+            }
+            break
+        case 1:
+            origin = p
+            fmt.Println("Origem:", origin)
+            state = 2
+            break
+        case 2:
+            point1 = p
+            fmt.Println("Ponto 1:", point1)
+            state = 3
+            break
+        case 3:
+            point2 = p
+            fmt.Println("Ponto 2:", point2)
+            state = 4
+        }
+        if state == 4 {
+            angle = doc.ConstrainAngle(Angle(origin, point1, point2))
+            break
+        }
     }
-    Delete(drawable, out)
-    drawable.RotatePoints(origin, Angle(origin, point1, point2))
-    out <- RegisterPoints(CurrentFilters()(drawable.PointChan()), drawable)
+    doc.Begin()
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        rotated := drawable.Clone()
+        rotated.SetId(drawable.GetId())
+        rotated.RotatePoints(origin, angle)
+        doc.Replace(drawable, rotated, out)
+    }
+    doc.Commit()
 }
 
-func MirrorHandler (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+func MirrorHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
     fmt.Println("Espelhar objeto")
     state := 0
-    var drawable Drawable
+    draws := doc.SelectedEditables()
+    if draws.Len() > 0 { state = 1 }
     var point1 image.Point
     var point2 image.Point
     for {
-        select{
-        case p := <-clickchan:
-            switch(state){
-            case 0:
-                drawable, _ = SearchNearPoint(p)
-                if drawable != nil { state = 1 }
-                break
-            case 1:
-                point1 = p
-                fmt.Println("Ponto 1:", point1)
-                state = 2
-                break
-            case 2:
-                point2 = p
-                fmt.Println("Ponto 2:", point2)
-                state = 3
-            }
-        case <-kbchan:
+        var from *image.Point
+        if state == 2 { from = &point1 }
+        p, ok := doc.NextPoint(clickchan, kbchan, from)
+        if !ok {
             return
         }
+        switch(state){
+        case 0:
+            drawable, _ := doc.SearchNearPoint(p)
+            if drawable != nil && doc.Editable(drawable) {
+                draws.PushBack(drawable)
+                state = 1
+            }
+            break
+        case 1:
+            point1 = p
+            fmt.Println("Ponto 1:", point1)
+            state = 2
+            break
+        case 2:
+            point2 = p
+            fmt.Println("Ponto 2:", point2)
+            state = 3
+        }
         if state == 3 { break }
     }
-    mirrored := Mirror(point1, point2, drawable)
-    out <- RegisterPoints(CurrentFilters()(mirrored.PointChan()), mirrored)
+    doc.Begin()
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        mirrored := Mirror(point1, point2, elem.Value.(Drawable))
+        doc.Add(mirrored, out)
+    }
+    doc.Commit()
 }
 
 func Mirror(p1 image.Point, p2 image.Point, drawable Drawable) Drawable{
@@ -1184,7 +5217,8 @@ func Mirror(p1 image.Point, p2 image.Point, drawable Drawable) Drawable{
     x2 := float64(int(p2.X))
     y2 := float64(int(p2.Y))
     var mirrored Drawable
-    if math.Fabs(ang) < math.Pi/float64(int(4)) {
+    // Axis closer to horizontal, in either direction
+    if math.Fabs(x2-x1) > math.Fabs(y2-y1) {
         origin := image.Point{0, int(float64(y1-x1*(y2-y1)/(x2-x1)))}
         ang = math.Pi/float64(int(2))-ang
         mirrored = drawable.Clone()
@@ -1202,121 +5236,451 @@ func Mirror(p1 image.Point, p2 image.Point, drawable Drawable) Drawable{
     return mirrored
 }
 
-func DeleteHandler (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+func DeleteHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
     fmt.Println("Apagar objeto")
+    draws := doc.SelectedEditables()
+    windows := doc.SelectedWindows()
+    if draws.Len() > 0 || windows.Len() > 0 {
+        doc.Begin()
+        for elem := draws.Front(); elem != nil; elem = elem.Next() {
+            doc.Delete(elem.Value.(Drawable), out)
+        }
+        // From the last, so the positions of the others hold
+        for elem := windows.Front(); elem != nil; elem = elem.Next() {
+            doc.DeleteWindow(elem.Value.(int), out)
+        }
+        doc.Commit()
+        return
+    }
     for {
     select {
         case p := <-clickchan:
-            drawable, _ := SearchNearPoint(p)
-            if drawable != nil {
-                go Delete(drawable, out)
+            p = doc.Click(p)
+            drawable, _ := doc.SearchNearPoint(p)
+            if drawable != nil && doc.Editable(drawable) {
+                doc.Delete(drawable, out)
                 return
             }
+            if drawable == nil {
+                if pos := doc.WindowAt(p); pos >= 0 {
+                    doc.DeleteWindow(pos, out)
+                    return
+                }
+            }
         case <-kbchan:
             return
     }
     }
 }
 
-func Delete(drawable Drawable, out chan chan ColorPoint) {
+func (doc *Document) Delete(drawable Drawable, out chan chan ColorPoint) {
     fmt.Println("Deletado")
-    blackpoints := make(chan ColorPoint, BUF_SIZE)
-    out <- blackpoints
-    colorpoints := CurrentFilters()(drawable.PointChan())
-    for ! closed(colorpoints) {
-        point := <-colorpoints
-        RemoveFromMatrix(point.point, drawable);
-        color_point := TopMatrixColorPoint(point.point)
-        blackpoints <- color_point
+    layer, elem := doc.LayerOf(drawable)
+    if layer == nil { return }
+    pos := 0
+    for e := layer.drawables.Front(); e != elem; e = e.Next() {
+        pos++
     }
-    close(blackpoints)
+    doc.Unregister(drawable)
+    doc.Record(&DeleteOp{drawable, layer, pos})
+    doc.Refresh(Damage(drawable), out)
 }
 
-func LineCreator (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+func LineCreator (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
     fmt.Println("Desenhar linha")
+    defer doc.ClearPreview()
     pa := [2]image.Point{}
     for i:=0; i<2; i++ {
-        select {
-        case p := <-clickchan:
-            pa[i] = p
-        case <-kbchan:
+        var from *image.Point
+        if i > 0 {
+            from = &pa[0]
+            doc.SetPreview(func(p image.Point) Drawable {
+                return &Line{pa[0], p, doc.style, Id{0}}
+            }, out)
+        }
+        p, ok := doc.NextPoint(clickchan, kbchan, from)
+        if !ok {
             return
         }
+        pa[i] = p
     }
-    line := Line{pa[0], pa[1], CurrentFigProps(), Id{0}}
-    out <- RegisterPoints(CurrentFilters()(line.PointChan()), &line)
-    counter_id++
-    (&line).SetId(counter_id)
+    line := Line{pa[0], pa[1], doc.style, Id{doc.NewId()}}
+    doc.Add(&line, out)
 }
 
-func SetColor (kbchan chan int) {
+func SetColor (doc *Document, kbchan chan int, out chan chan ColorPoint) {
+    before := doc.style
     switch <- kbchan {
     case 'r':
-        currentColor = image.RGBAColor{255, 0, 0, 255}
+        doc.style.color = image.RGBAColor{255, 0, 0, 255}
         fmt.Println("Vermelho selecionado")
         break
     case 'g':
-        currentColor = image.RGBAColor{0, 255, 0, 255}
+        doc.style.color = image.RGBAColor{0, 255, 0, 255}
         fmt.Println("Verde selecionado")
         break
     case 'b':
-        currentColor = image.RGBAColor{0, 0, 255, 255}
+        doc.style.color = image.RGBAColor{0, 0, 255, 255}
         fmt.Println("Azul selecionado")
         break
     case 'w':
-        currentColor = image.RGBAColor{255, 255, 255, 255}
+        doc.style.color = image.RGBAColor{255, 255, 255, 255}
         fmt.Println("Branco selecionado")
+    default:
+        return
     }
+    color := doc.style.color
+    doc.Begin()
+    doc.Record(&StyleOp{before, doc.style})
+    doc.RestyleSelection(func(props *FigProps) { props.color = color }, out)
+    doc.Commit()
 }
 
-func MoveHandler (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+func MoveHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
     fmt.Println("Mover objeto")
+    defer doc.ClearPreview()
     has_origin := false
-    var drawable Drawable
+    // With a selection the first click is only the base point
+    draws := doc.SelectedEditables()
     var origin image.Point
     for {
-    select {
-        case p := <-clickchan:
-            if has_origin == false {
-                drawable, origin = SearchNearPoint(p)
-                if drawable != nil {
+        var from *image.Point
+        if has_origin { from = &origin }
+        p, ok := doc.NextPoint(clickchan, kbchan, from)
+        if !ok {
+            return
+        }
+        if has_origin == false {
+            if draws.Len() > 0 {
+                origin = p
+                has_origin = true
+            } else {
+                var drawable Drawable
+                drawable, origin = doc.SearchNearPoint(p)
+                if drawable != nil && doc.Editable(drawable) {
+                    draws.PushBack(drawable)
                     has_origin = true
                 }
-            } else {
-                dest := p
-                moviment := dest.Sub(origin)
-                //fmt.Println("Move (%d, %d)", moviment.X, moviment.Y)
-                Delete(drawable, out)
-                drawable.Move(moviment)
-                out <- RegisterPoints(CurrentFilters()(drawable.PointChan()), drawable)
-                return
             }
-        case <-kbchan:
+            // Typed "@dx,dy" moves by exactly dx,dy
+            doc.lastPoint = origin
+            if has_origin {
+                doc.SetPreview(func(p image.Point) Drawable {
+                    moved := new(list.List)
+                    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+                        clone := elem.Value.(Drawable).Clone()
+                        clone.Move(p.Sub(origin))
+                        moved.PushBack(clone)
+                    }
+                    return &Grouping{moved, Id{0}}
+                }, out)
+            }
+        } else {
+            dest := p
+            moviment := dest.Sub(origin)
+            //fmt.Println("Move (%d, %d)", moviment.X, moviment.Y)
+            doc.Begin()
+            for elem := draws.Front(); elem != nil; elem = elem.Next() {
+                doc.MoveDrawable(elem.Value.(Drawable), moviment, out)
+            }
+            doc.Commit()
             return
+        }
+    }
+}
+
+func (doc *Document) MoveDrawable(drawable Drawable, delta image.Point, out chan chan ColorPoint) {
+    old := drawable.Bounds()
+    drawable.Move(delta)
+    doc.Update(drawable, old, out)
+    doc.Record(&MoveOp{drawable, delta})
+}
+
+// Aligns or distributes the bounding boxes of the clicked objects. The
+// key that ends the selection chooses how
+func AlignHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Alinhar objetos")
+    // The selection, or the objects clicked before the key
+    draws := doc.SelectedEditables()
+    var key int
+    if draws.Len() > 0 {
+        key = <-kbchan
     }
+    for_breaker := draws.Len() > 0
+    for !for_breaker {
+        select{
+        case p := <-clickchan:
+            p = doc.Click(p)
+            drawable, _ := doc.SearchNearPoint(p)
+            if drawable != nil && doc.Editable(drawable) && !ListContains(draws, drawable) {
+                draws.PushBack(drawable)
+            }
+        case key = <-kbchan:
+           for_breaker = true
+        }
+    }
+    doc.Begin()
+    defer doc.Commit()
+    switch key {
+    case 'l', 'c', 'r', 't', 'm', 'b':
+        if draws.Len() < 2 {
+            fmt.Println("Selecione ao menos 2 objetos")
+            return
+        }
+        Align(doc, draws, key, out)
+    case 'h', 'v', 'H', 'V':
+        if draws.Len() < 3 {
+            fmt.Println("Selecione ao menos 3 objetos")
+            return
+        }
+        Distribute(doc, draws, key, out)
     }
 }
 
-func WindowCreator (clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
-    fmt.Println("Criar janela")
-    points := [3]image.Point{}
-    for_breaker := false
-    for i := 0; i < 3; i++ {
+// Changes the stacking order of the clicked object: 'u' one step up,
+// 'd' one step down, 't' to the top, 'b' to the bottom
+func ZOrderHandler (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Ordem dos objetos")
+    var drawable Drawable
+    for drawable == nil {
         select {
         case p := <-clickchan:
-            points[i] = p
+            p = doc.Click(p)
+            drawable, _ = doc.SearchNearPoint(p)
         case <-kbchan:
-            for_breaker = true
-            break
+            return
         }
-        if for_breaker {
-            break
+    }
+    if !doc.Editable(drawable) { return }
+    fmt.Println("u: subir, d: descer, t: topo, b: fundo")
+    layer, before := doc.PositionOf(drawable)
+    changed := false
+    switch <-kbchan {
+    case 'u':
+        changed = doc.Raise(drawable)
+    case 'd':
+        changed = doc.Lower(drawable)
+    case 't':
+        changed = doc.BringToFront(drawable)
+    case 'b':
+        changed = doc.SendToBack(drawable)
+    }
+    if changed {
+        _, after := doc.PositionOf(drawable)
+        doc.Record(&ZOrderOp{drawable, layer, before, after})
+        doc.Refresh(Damage(drawable), out)
+    }
+}
+
+func ListContains(l *list.List, value interface{}) bool {
+    for elem := l.Front(); elem != nil; elem = elem.Next() {
+        if elem.Value == value {
+            return true
+        }
+    }
+    return false
+}
+
+// Aligns to the left, center, right, top, middle or bottom of the
+// bounding box of all objects
+func Align(doc *Document, draws *list.List, key int, out chan chan ColorPoint) {
+    var all image.Rectangle
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        all = RectUnion(all, elem.Value.(Drawable).Bounds())
+    }
+    center := RectCenter(all)
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        bounds := drawable.Bounds()
+        var delta image.Point
+        switch key {
+        case 'l':
+            delta.X = all.Min.X - bounds.Min.X
+        case 'c':
+            delta.X = center.X - RectCenter(bounds).X
+        case 'r':
+            delta.X = all.Max.X - bounds.Max.X
+        case 't':
+            delta.Y = all.Min.Y - bounds.Min.Y
+        case 'm':
+            delta.Y = center.Y - RectCenter(bounds).Y
+        case 'b':
+            delta.Y = all.Max.Y - bounds.Max.Y
+        }
+        if delta.X != 0 || delta.Y != 0 {
+            doc.MoveDrawable(drawable, delta, out)
+        }
+    }
+}
+
+// Distributes horizontally ('h', 'H') or vertically ('v', 'V'), with
+// equal spacing between boxes or, in uppercase, between centers. The
+// first and last objects stay in place
+func Distribute(doc *Document, draws *list.List, key int, out chan chan ColorPoint) {
+    vertical := key == 'v' || key == 'V'
+    by_center := key == 'H' || key == 'V'
+    n := draws.Len()
+    sorted := make([]Drawable, n)
+    start := make([]int, n)
+    size := make([]int, n)
+    order := make([]int, n)
+    i := 0
+    for elem := draws.Front(); elem != nil; elem = elem.Next() {
+        drawable := elem.Value.(Drawable)
+        bounds := drawable.Bounds()
+        s, l := bounds.Min.X, bounds.Dx()
+        o := s
+        if by_center { o = RectCenter(bounds).X }
+        if vertical {
+            s, l = bounds.Min.Y, bounds.Dy()
+            o = s
+            if by_center { o = RectCenter(bounds).Y }
+        }
+        // Insertion sort by start, or by center
+        j := i
+        for ; j > 0 && order[j-1] > o; j-- {
+            sorted[j], start[j], size[j], order[j] = sorted[j-1], start[j-1], size[j-1], order[j-1]
+        }
+        sorted[j], start[j], size[j], order[j] = drawable, s, l, o
+        i++
+    }
+    total := 0
+    for i = 0; i < n; i++ {
+        total += size[i]
+    }
+    first, last := start[0], start[n-1] + size[n-1]
+    position := float64(first)
+    for i = 0; i < n; i++ {
+        var target int
+        if by_center {
+            first_center := float64(start[0]) + float64(size[0])/2
+            last_center := float64(start[n-1]) + float64(size[n-1])/2
+            center := first_center + (last_center - first_center) * float64(i) / float64(n-1)
+            target = Round(center - float64(size[i])/2)
+        } else {
+            target = Round(position)
+            position += float64(size[i]) + float64(last - first - total) / float64(n-1)
+        }
+        delta := image.Point{target - start[i], 0}
+        if vertical {
+            delta = image.Point{0, target - start[i]}
         }
+        if delta.X != 0 || delta.Y != 0 {
+            doc.MoveDrawable(sorted[i], delta, out)
+        }
+    }
+}
+
+func WindowCreator (doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Criar janela")
+    defer doc.ClearPreview()
+    points := [3]image.Point{}
+    zoom := float64(doc.counter)
+    props := FigProps{image.RGBAColor{255, 255, 0, 255}, DOTTED, false}
+    for i := 0; i < 3; {
+        switch i {
+        case 1:
+            doc.SetPreview(func(p image.Point) Drawable {
+                return RectPoligon(points[0], p, props)
+            }, out)
+        case 2:
+            doc.SetPreview(func(p image.Point) Drawable {
+                size := points[1].Sub(points[0])
+                if zoom <= 0 { return nil }
+                return RectPoligon(p, p.Add(image.Point{ZoomCoord(size.X, zoom), ZoomCoord(size.Y, zoom)}), props)
+            }, out)
+        }
+        input := doc.NextInput(clickchan, kbchan, nil)
+        switch input.kind {
+        case INPUT_CANCEL:
+            return
+        case INPUT_NUMBER:
+            zoom = input.value
+            fmt.Println("Zoom:", zoom)
+            continue
+        }
+        points[i] = input.point
+        i++
+    }
+    if zoom <= 0 {
+        fmt.Println("Zoom invalido:", zoom)
+        return
+    }
+    window := NewWindow(points[0], points[1], points[2], zoom)
+    op := &WindowOp{doc.windows.Len(), nil, &window}
+    op.Redo(doc, out)
+    doc.Record(op)
+}
+
+// Window commands on the selected window, or the one chosen by its
+// number or by a click on a border. 'o' takes a new source, 'p' a new
+// place for the target, 'z' a new zoom and 'd' deletes it
+func WindowHandler(doc *Document, clickchan <-chan image.Point, kbchan chan int, out chan chan ColorPoint) {
+    fmt.Println("Janelas")
+    doc.PrintWindows()
+    if doc.windows.Len() == 0 { return }
+    pos := -1
+    if selected := doc.SelectedWindows(); selected.Len() == 1 {
+        pos = selected.Front().Value.(int)
+    } else {
+        fmt.Println("Escolha a janela: numero e Enter, ou clique na borda")
+        input := doc.NextInput(clickchan, kbchan, nil)
+        switch input.kind {
+        case INPUT_POINT:
+            pos = doc.WindowAt(input.point)
+        case INPUT_NUMBER:
+            if n := int(input.value); n >= 1 && n <= doc.windows.Len() {
+                pos = n - 1
+            }
+        }
+    }
+    if pos < 0 {
+        fmt.Println("Nenhuma janela escolhida")
+        return
+    }
+    window := doc.WindowElem(pos).Value.(Window)
+    edited := window
+    fmt.Println("Janela", pos + 1, "- o: origem, p: destino, z: zoom, d: apagar")
+    defer doc.ClearPreview()
+    props := FigProps{image.RGBAColor{255, 255, 0, 255}, DOTTED, false}
+    var after *Window = &edited
+    switch <-kbchan {
+    case 'o':
+        a, ok := doc.NextPoint(clickchan, kbchan, nil)
+        if !ok { return }
+        doc.SetPreview(func(p image.Point) Drawable {
+            return RectPoligon(a, p, props)
+        }, out)
+        b, ok := doc.NextPoint(clickchan, kbchan, nil)
+        if !ok { return }
+        edited = NewWindow(a, b, window.target, window.zoom)
+    case 'p':
+        sx, sy := window.TargetSize()
+        doc.SetPreview(func(p image.Point) Drawable {
+            return RectPoligon(p, p.Add(image.Point{sx, sy}), props)
+        }, out)
+        p, ok := doc.NextPoint(clickchan, kbchan, nil)
+        if !ok { return }
+        edited.target = p
+    case 'z':
+        fmt.Println("Zoom:")
+        value, ok := doc.NextNumber(clickchan, kbchan)
+        if !ok { return }
+        if value <= 0 {
+            fmt.Println("Zoom invalido:", value)
+            return
+        }
+        edited.zoom = value
+    case 'd':
+        after = nil
+    default:
+        return
     }
-    window := Window{points[0], points[1], points[2], currentCounter}
-    RegisterWindow(window)
-    out <- window.PointChan()
-    out <- CurrentFilters()(window.RedrawContent())
+    doc.ClearPreview()
+    op := &WindowOp{pos, &window, after}
+    op.Redo(doc, out)
+    doc.Record(op)
+    doc.PrintWindows()
 }
 
 // Turns kbchan into a read and writable chan
@@ -1340,31 +5704,26 @@ func Draw (surface draw.Image, pointchan chan ColorPoint) {
     }
 }
 
-func RegisterPoints (pointchan chan ColorPoint, drawable Drawable) chan ColorPoint {
-    outchan := make(chan ColorPoint, BUF_SIZE)
-    go func() {
-        for ! closed(pointchan) {
-            colorpoint := <-pointchan
-            colorpoint.drawable = &drawable
-            PushMatrix(colorpoint)
-            outchan <- colorpoint
-        }
-        close (outchan)
-    }()
-    return outchan
-}
+
 
 func main() {
     context, _ := x11.NewWindow()
     context.FlushImage()
+    screenRect = context.Screen().Bounds()
+    doc := NewDocument()
     kbchan := RWKBChan(context.KeyboardChan());
-    clickchan := MouseClickFilters(MouseHandler(context.MouseChan()))
-    colorpointchanchan := EventProcessor(clickchan, kbchan)
+    indicators := make(chan chan ColorPoint)
+    doc.indicators = indicators
+    clickchan := SplitMouse(doc, MouseHandler(context.MouseChan()))
+    colorpointchanchan := EventProcessor(doc, clickchan, kbchan)
     for {
         select {
         case colorpointchan := <-colorpointchanchan:
             Draw(context.Screen(), colorpointchan)
             context.FlushImage()
+        case indicator := <-indicators:
+            Draw(context.Screen(), indicator)
+            context.FlushImage()
         case <-context.QuitChan():
             fmt.Println("Quit")
             return
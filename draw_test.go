@@ -0,0 +1,144 @@
+package main
+
+import (
+    "container/list"
+    "image"
+    "math"
+    "testing"
+)
+
+func Square(x int, y int, size int) *list.List {
+    points := new(list.List)
+    points.PushBack(image.Point{x, y})
+    points.PushBack(image.Point{x + size, y})
+    points.PushBack(image.Point{x + size, y + size})
+    points.PushBack(image.Point{x, y + size})
+    return points
+}
+
+// Sum of the areas of the paths, all taken as positive
+func PathsArea(paths *list.List) float64 {
+    total := 0.0
+    for elem := paths.Front(); elem != nil; elem = elem.Next() {
+        points := elem.Value.(*list.List)
+        area := 0.0
+        for p := points.Front(); p != nil; p = p.Next() {
+            next := p.Next()
+            if next == nil { next = points.Front() }
+            a, b := p.Value.(image.Point), next.Value.(image.Point)
+            area += float64(a.X*b.Y - b.X*a.Y)
+        }
+        total += math.Fabs(area) / 2
+    }
+    return total
+}
+
+func TestBooleanSharedEdge(t *testing.T) {
+    for _, op := range []int{BOOL_UNION, BOOL_XOR} {
+        paths := BooleanPaths(Square(0, 0, 10), Square(10, 0, 10), op)
+        if paths.Len() != 1 {
+            t.Errorf("op %d: %d paths, want 1", op, paths.Len())
+            continue
+        }
+        if area := PathsArea(paths); area != 200 {
+            t.Errorf("op %d: area %v, want 200", op, area)
+        }
+        // The shared edge is no longer a boundary
+        for p := paths.Front().Value.(*list.List).Front(); p != nil; p = p.Next() {
+            if point := p.Value.(image.Point); point.X == 10 && point.Y != 0 && point.Y != 10 {
+                t.Errorf("op %d: point %v on the shared edge", op, point)
+            }
+        }
+    }
+}
+
+func TestBooleanPartialSharedEdge(t *testing.T) {
+    paths := BooleanPaths(Square(0, 0, 10), Square(10, 5, 10), BOOL_UNION)
+    if paths.Len() != 1 || PathsArea(paths) != 200 {
+        t.Errorf("union: %d paths of area %v, want 1 of 200", paths.Len(), PathsArea(paths))
+    }
+}
+
+func TestBooleanTouchingVertex(t *testing.T) {
+    for _, op := range []int{BOOL_UNION, BOOL_XOR} {
+        paths := BooleanPaths(Square(0, 0, 10), Square(10, 10, 10), op)
+        if area := PathsArea(paths); area != 200 {
+            t.Errorf("op %d: area %v, want 200", op, area)
+        }
+    }
+}
+
+func TestBooleanOverlap(t *testing.T) {
+    a, b := Square(0, 0, 10), Square(5, 5, 10)
+    cases := []struct {
+        op int
+        area float64
+    }{
+        {BOOL_UNION, 175},
+        {BOOL_INTERSECTION, 25},
+        {BOOL_DIFFERENCE, 75},
+        {BOOL_XOR, 150},
+    }
+    for _, c := range cases {
+        if area := PathsArea(BooleanPaths(a, b, c.op)); area != c.area {
+            t.Errorf("op %d: area %v, want %v", c.op, area, c.area)
+        }
+    }
+}
+
+func TestParseInput(t *testing.T) {
+    doc := NewDocument()
+    doc.lastPoint = image.Point{10, 10}
+    points := []struct {
+        text string
+        point image.Point
+    }{
+        {"3,4", image.Point{3, 4}},
+        {"@5,-3", image.Point{15, 7}},
+        {"20<90", image.Point{0, -20}},
+        {"@10<180", image.Point{0, 10}},
+    }
+    for _, c := range points {
+        input, ok := doc.ParseInput(c.text)
+        if !ok || input.kind != INPUT_POINT || !input.point.Eq(c.point) {
+            t.Errorf("%q: %v %v, want point %v", c.text, input, ok, c.point)
+        }
+    }
+    input, ok := doc.ParseInput("<45")
+    if !ok || input.kind != INPUT_ANGLE || math.Fabs(input.value + math.Pi/4) > 1e-9 {
+        t.Errorf("<45: %v %v, want angle lock", input, ok)
+    }
+    input, ok = doc.ParseInput("7.5")
+    if !ok || input.kind != INPUT_NUMBER || input.value != 7.5 {
+        t.Errorf("7.5: %v %v, want number", input, ok)
+    }
+    for _, text := range []string{"", "@7", "a,b", "1<x"} {
+        if _, ok := doc.ParseInput(text); ok {
+            t.Errorf("%q accepted", text)
+        }
+    }
+}
+
+func TestClipLine(t *testing.T) {
+    rect := image.Rect(10, 10, 20, 20)
+    cases := []struct {
+        a, b image.Point
+        ok bool
+        ca, cb image.Point
+    }{
+        {image.Point{0, 15}, image.Point{15, 15}, true, image.Point{10, 15}, image.Point{15, 15}},
+        {image.Point{15, 15}, image.Point{30, 15}, true, image.Point{15, 15}, image.Point{19, 15}},
+        {image.Point{15, 0}, image.Point{15, 15}, true, image.Point{15, 10}, image.Point{15, 15}},
+        {image.Point{15, 15}, image.Point{15, 30}, true, image.Point{15, 15}, image.Point{15, 19}},
+        {image.Point{0, 0}, image.Point{30, 30}, true, image.Point{10, 10}, image.Point{19, 19}},
+        {image.Point{12, 12}, image.Point{17, 14}, true, image.Point{12, 12}, image.Point{17, 14}},
+        {image.Point{0, 0}, image.Point{5, 30}, false, image.Point{}, image.Point{}},
+        {image.Point{0, 25}, image.Point{30, 25}, false, image.Point{}, image.Point{}},
+    }
+    for _, c := range cases {
+        a, b, ok := ClipLine(c.a, c.b, rect)
+        if ok != c.ok || ok && (!a.Eq(c.ca) || !b.Eq(c.cb)) {
+            t.Errorf("%v-%v: %v-%v %v, want %v-%v %v", c.a, c.b, a, b, ok, c.ca, c.cb, c.ok)
+        }
+    }
+}